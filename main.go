@@ -1,33 +1,36 @@
 package main
 
 import (
-	"github.com/kevinvalk/astrotime"
+	"github.com/kevinvalk/piglow-ambient/piglowambient"
 	"github.com/wjessop/go-piglow"
-	"github.com/tatsushid/go-fastping"
-	"code.google.com/p/gcfg"
+	"context"
 	"time"
 	"strconv"
-	"math"
 	"log"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/signal"
 	"syscall"
-	"net"
 	"fmt"
 	"flag"
+	"path/filepath"
+	"sync"
 )
 
 const VERSION = "0.3.0"
 
-var glow *piglow.Piglow
-var isPaused bool
-var isRunning bool
 var pidPath string
+var deviceName string
 var logPath string
 var cfgPath string
-var cfg Config
-var currentPower int
+var previewPath string
+var calendarPath string
+var ctlCommand string
+var pidRequired bool
+var debugStacks bool
+var profileName string
+var once bool
 
 func initFlags(){
 	// Adjust command line help text
@@ -41,145 +44,207 @@ func initFlags(){
 
 	// Command line arguments
 	flag.StringVar(&pidPath, "pidfile", "", "name of the PID file")
+	flag.BoolVar(&pidRequired, "pidfile-required", false, "exit when the PID file cannot be written instead of continuing without")
 	flag.StringVar(&logPath, "logfile", "-", "log to a specified file, - for stdout")
 	flag.StringVar(&cfgPath, "cfgfile", "/etc/piglow-ambient.gcfg", "configuration file")
+	flag.StringVar(&deviceName, "device", "", "[Device] section for -ctl, -preview and -exportcal, the first one by name when not given")
+	flag.StringVar(&profileName, "profile", "", "start with this [Profile] section, none for the base settings")
+	flag.StringVar(&previewPath, "preview", "", "write the brightness of the coming 24 hours as CSV to this file and exit")
+	flag.StringVar(&calendarPath, "exportcal", "", "write the fades of the coming week as iCalendar to this file and exit")
+	flag.BoolVar(&debugStacks, "debug-stacks", false, "include the stack of every goroutine in the SIGUSR2 debug dump")
+	flag.BoolVar(&once, "once", false, "set the scheduled brightness for right now and exit")
+	flag.StringVar(&ctlCommand, "ctl", "", "send a command (e.g. testpattern) to the running daemon and exit")
 	flag.Parse()
 }
 
-func initSignal() {
+func initInterrupt(cancel context.CancelFunc) {
 	ChannelInterrupt := make(chan os.Signal, 1)
 	signal.Notify(ChannelInterrupt, os.Interrupt, os.Kill, syscall.SIGTERM, syscall.SIGQUIT)
 
 	go func(){
 		<- ChannelInterrupt
 		log.Printf("Goodbye!")
-		isRunning = false
+		cancel()
 	}()
+}
+
+// The controllers of every device that started, the signals go to all of them
+type controllers struct {
+	lock sync.Mutex
+	list []*piglowambient.Controller
+}
+
+func (c *controllers) add(ctl *piglowambient.Controller) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.list = append(c.list, ctl)
+}
 
+func (c *controllers) each(do func(ctl *piglowambient.Controller)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, ctl := range c.list {
+		do(ctl)
+	}
+}
+
+func initSignal(ctls *controllers) {
 	ChannelReload := make(chan os.Signal, 1)
 	signal.Notify(ChannelReload, syscall.SIGHUP)
 
 	go func(){
-		for isRunning {
+		for {
 			<- ChannelReload
-			log.Printf("Partially reloading config (only lat/long)...")
-			initConfig()
+			log.Printf("Reloading config...")
+			ctls.each(func(ctl *piglowambient.Controller) { ctl.ReloadFile(cfgPath) })
 		}
 	}()
-}
 
-func initConfig() {
-	err := gcfg.ReadFileInto(&cfg, cfgPath)
-	if err != nil {
-		log.Fatalf("Failed to parse gcfg data: %s", err)
-	}
+	ChannelStatus := make(chan os.Signal, 1)
+	signal.Notify(ChannelStatus, syscall.SIGUSR1)
+
+	go func(){
+		for {
+			<- ChannelStatus
+			ctls.each(func(ctl *piglowambient.Controller) { ctl.LogStatus() })
+		}
+	}()
+
+	ChannelDebug := make(chan os.Signal, 1)
+	signal.Notify(ChannelDebug, syscall.SIGUSR2)
+
+	go func(){
+		for {
+			<- ChannelDebug
+			ctls.each(func(ctl *piglowambient.Controller) { ctl.LogDebug(debugStacks) })
+		}
+	}()
 }
 
-func initPing() {
-	// Default state
-	lastState := PingUnknown
-	var isRecv bool
+// Create the directory a file goes in when it does not exist yet (e.g. on a first deploy)
+func makeParentDir(path string) error {
+	return os.MkdirAll(filepath.Dir(path), 0750)
+}
 
-	// Resolve host
-	p := fastping.NewPinger()
-	ra, err := net.ResolveIPAddr("ip4:icmp", cfg.Settings.PingIp)
+// Open the log file for appending, also when its directory is not there yet
+func openLogFile(path string) (*os.File, error) {
+	if err := makeParentDir(path); err != nil {
+		return nil, fmt.Errorf("Could not create the log directory: %w", err)
+	}
+	logFile, err := os.OpenFile(path, os.O_RDWR | os.O_CREATE | os.O_APPEND, 0640)
 	if err != nil {
-		log.Fatalf("error resolving IP address: %v", err)
+		return nil, fmt.Errorf("Could not open the log file: %w", err)
 	}
+	return logFile, nil
+}
 
-	// Disabling this feature if no IP given
-	if ra.IP == nil {
-		log.Printf("No ping IP given (%s) (or resolved), disabling ping check ...", cfg.Settings.PingIp)
-		return
+func writePidFile(path string) error {
+	if err := makeParentDir(path); err != nil {
+		return err
 	}
+	return ioutil.WriteFile(path, []byte(strconv.Itoa(os.Getpid())), 0644)
+}
 
-	// Add IP and add the receive handler
-	p.AddIPAddr(ra)
-	err = p.AddHandler("receive", func(addr *net.IPAddr, rtt time.Duration) {
-		isRecv = true
-		if lastState == PingDown {
-			log.Printf("Remote %s came up, RTT: %v", addr.String(), rtt)
-			resume()
+// Device the -device flag asks for, the first one by name when not given and none without device sections
+func pickDevice(cfg piglowambient.Config) string {
+	names := cfg.DeviceNames()
+	if deviceName != "" {
+		if _, ok := cfg.Device[deviceName]; !ok {
+			log.Fatalf("No [Device \"%s\"] section", deviceName)
 		}
-		lastState = PingUp
-	})
-	if err != nil {
-		log.Fatalf("error adding receive handler: %v", err)
+		return deviceName
+	}
+	if len(names) == 0 {
+		return ""
 	}
+	return names[0]
+}
 
-	// Add the idle handler, this get called always so we have to check if we received something in the receive (isRecv flag)
-	err = p.AddHandler("idle", func() {
-		if isRecv {
-			return
-		}
-		if lastState == PingUp || lastState == PingUnknown {
-			log.Printf("Remote %s went down", cfg.Settings.PingIp)
-			pause()
-		}
-		lastState = PingDown
-	})
-	if err != nil {
-		log.Fatalf("error adding idle handler: %v", err)
+// Every device section runs on its own, without any there is the one for the top-level settings
+func runDevices(cfg piglowambient.Config) []string {
+	if names := cfg.DeviceNames(); len(names) > 0 {
+		return names
 	}
+	return []string{""}
+}
 
-	// Ping loop
-	go func(){
-		for isRunning {
-			isRecv = false
-			err = p.Run()
-			if err != nil {
-				log.Fatalf("error while pinging: %v", err)
-			}
-			time.Sleep(time.Minute) // Check every minute for host
+// Setup a PiGlow and make sure there really is one, go-piglow opens the one on the default I2C bus
+func openGlow(cfg piglowambient.Config) piglowambient.Glow {
+	piglowDevice, err := piglow.NewPiglow()
+	if err == nil {
+		err = piglowambient.Probe(piglowDevice)
+	}
+	if err != nil {
+		if !cfg.Settings.DryRunWithoutDevice {
+			log.Fatalf("No PiGlow detected on the I2C bus: %v", err)
 		}
-	}()
+		log.Printf("No PiGlow detected on the I2C bus, running without one: %v", err)
+		return piglowambient.DryRunGlow{}
+	}
+	return piglowDevice
 }
 
-func pause() {
-	isPaused = true
-
-	// Do quick fade out
-	time.Sleep(time.Second)
-	for i := currentPower; i >= 0; i-- {
-		setGlow(i)
-		time.Sleep(time.Millisecond * 35) // 9 seconds
+// Wait for the startup delay, then run the device until the context is done (or only once with -once)
+func runDevice(ctx context.Context, cfg piglowambient.Config, device string, logBuffer *piglowambient.LogBuffer, ctls *controllers) {
+	if !piglowambient.WaitStartupDelay(ctx, cfg.ForDevice(device)) {
+		return
 	}
-}
 
-func resume() {
-	isPaused = false
+	ctl := piglowambient.NewDevice(cfg, device, openGlow(cfg.ForDevice(device)))
+	ctl.SetConfigFile(cfgPath)
+	ctl.SetLogBuffer(logBuffer)
+	if profileName != "" {
+		if err := ctl.UseProfile(profileName); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	// Do quick fade out
-	time.Sleep(time.Second)
-	for i := currentPower; i <= 255; i++ {
-		setGlow(i)
-		time.Sleep(time.Millisecond * 35) // 9 seconds
+	// Only set what the schedule wants now, e.g. from cron
+	if once {
+		ctl.ShowOnce()
+		return
 	}
+
+	ctls.add(ctl)
+	ctl.Run(ctx)
 }
 
-func setGlow(power int) {
-	glow.SetAll(uint8(power))
-	currentPower = power
-	if err := glow.Apply(); err != nil {
-		log.Fatal("Could not set PiGlow: ", err)
+// Send the command given on the command line to the running daemon
+func runCommand() {
+	cfg, err := piglowambient.ReadConfigFile(cfgPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	socket := cfg.ForDevice(pickDevice(cfg)).Settings.ControlSocket
+	if socket == "" {
+		log.Fatal("No ControlSocket configured")
 	}
+
+	reply, err := piglowambient.SendCommand(socket, ctlCommand)
+	if err != nil {
+		log.Fatalf("error sending command: %v", err)
+	}
+	fmt.Println(reply)
 }
 
 func main() {
 	// Do initializing
-	isRunning = true
-	isPaused = false
 	initFlags()
-	initSignal()
+	if ctlCommand != "" {
+		runCommand()
+		return
+	}
 
-	// Setup logging
+	// Setup logging, the last lines are kept in memory as well for the logs command
+	logBuffer := piglowambient.NewLogBuffer(piglowambient.LOG_BUFFER_LINES)
+	log.SetOutput(io.MultiWriter(os.Stderr, logBuffer))
 	if logPath != "-" {
-		logFile, err := os.OpenFile(logPath, os.O_RDWR | os.O_CREATE | os.O_APPEND, 0640)
+		logFile, err := openLogFile(logPath)
 		if err != nil {
-			log.Fatalf("error opening file: %v", err)
+			log.Fatal(err)
 		}
 		defer logFile.Close()
-		log.SetOutput(logFile)
+		log.SetOutput(io.MultiWriter(logFile, logBuffer))
 	}
 
 	if logPath != "-" {
@@ -187,102 +252,57 @@ func main() {
 	}
 	log.Printf("Welcome to PiGlow Ambient version %s", VERSION)
 
-	// Write pid file
+	// Write pid file, on a read-only filesystem we can do without unless asked not to
 	if pidPath != "" {
-		if err := ioutil.WriteFile(pidPath, []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
-			log.Fatalf("error creating PID file: %v", err)
+		if err := writePidFile(pidPath); err != nil {
+			if pidRequired {
+				log.Fatalf("error creating PID file: %v", err)
+			}
+			log.Printf("Warning: could not create PID file, continuing without: %v", err)
+		} else {
+			defer os.Remove(pidPath) // Remove when we exit
 		}
-		defer os.Remove(pidPath) // Remove when we exit
 	}
 
 	// Read configuration file
-	initConfig()
-
-	// Initialize transition speed
-	transitionTime, err := getTransitionSpeed(cfg.Settings.TransitionSpeed)
+	cfg, err := piglowambient.ReadConfigFile(cfgPath)
 	if err != nil {
 		log.Fatal(err)
 	}
-	if transitionTime <= 0 {
-		log.Fatal("Need to have a transition period that is greater then zero!")
-	}
 
-	// Do the initial calculations
-	transitionDuration := time.Duration(transitionTime) * time.Second
-	sleepDuration := time.Duration((float64(transitionTime)/float64(MAX_POWER)*0.9) * 1000000000)  // Dynamic calculate sleep time to optimize CPU usage while maintaining smooth transitions when the transition period is very small
-	if sleepDuration > time.Second {
-		sleepDuration = time.Second
-	}
+	device := pickDevice(cfg)
 
-	// Calculate sunset/sunrise, I am using this so that no matter when you start this program it will always have to correct sunrise/sunset
-	sunrise := astrotime.NextSunrise(time.Now(), cfg.Settings.Latitude, cfg.Settings.Longitude)
-	sunset := astrotime.PreviousSunset(sunrise, cfg.Settings.Latitude, cfg.Settings.Longitude)
-
-	// Calculate the fade times
-	fadeOutTime := sunrise.Add(-transitionDuration/2)
-	fadeInTime := sunset.Add(-transitionDuration/2)
-
-	// Setup PiGlow
-	glow, err = piglow.NewPiglow()
-	if err != nil {
-		log.Fatal("Could not create a PiGlow object: ", err)
-	}
-	setGlow(0)
-
-	// Announce some basic information
-	log.Printf("Transition time in seconds: %d, Sleep duration: %.04f", transitionTime, sleepDuration.Seconds())
-	log.Printf("Latitude: %f, Longitude: %f", cfg.Settings.Latitude, cfg.Settings.Longitude)
-	log.Printf("The next fadeIn  is %02d:%02d:%02d on %d/%d/%d", fadeInTime.Hour(), fadeInTime.Minute(), fadeInTime.Second(), fadeInTime.Month(), fadeInTime.Day(), fadeInTime.Year())
-	log.Printf("The next fadeOut is %02d:%02d:%02d on %d/%d/%d", fadeOutTime.Hour(), fadeOutTime.Minute(), fadeOutTime.Second(), fadeOutTime.Month(), fadeOutTime.Day(), fadeOutTime.Year())
-
-	// Initialize pings checks just before main loop (to let the program boot)
-	initPing()
-
-	// Main loop
-	var power int
-	for isRunning {
-		// Sleep
-		time.Sleep(sleepDuration)
-
-		// Check if we are sleeping
-		if isPaused {
-			continue
+	// Only show what the schedule would do
+	if previewPath != "" {
+		if err := piglowambient.NewDevice(cfg, device, nil).WritePreview(previewPath, time.Now()); err != nil {
+			log.Fatalf("error writing preview: %v", err)
 		}
-
-		// FadeIn
-		if elapsed := time.Now().Sub(fadeInTime); elapsed > 0 {
-			// Calculate brightness with maximum of 255
-			power = int(math.Ceil((MAX_POWER/float64(transitionTime))*elapsed.Seconds()))
-			if power > 255 {
-				power = 255
-			}
-
-			// Set the new brightness
-			setGlow(power)
-
-			// If we have complete our fadeIn calculate next fadeIn
-			if power >= 255 {
-				fadeInTime = astrotime.NextSunset(time.Now(), cfg.Settings.Latitude, cfg.Settings.Longitude).Add(-transitionDuration/2)
-				log.Printf("The next fadeIn  is %02d:%02d:%02d on %d/%d/%d", fadeInTime.Hour(), fadeInTime.Minute(), fadeInTime.Second(), fadeInTime.Month(), fadeInTime.Day(), fadeInTime.Year())
-			}
+		log.Printf("Preview written to %s", previewPath)
+		return
+	}
+	if calendarPath != "" {
+		if err := piglowambient.NewDevice(cfg, device, nil).WriteCalendar(calendarPath, time.Now()); err != nil {
+			log.Fatalf("error writing calendar: %v", err)
 		}
+		log.Printf("Calendar written to %s", calendarPath)
+		return
+	}
 
-		// FadeOut
-		if elapsed := time.Now().Sub(fadeOutTime); elapsed > 0 {
-			// Calculate brightness with minimum of zero
-			power = 255-int(math.Floor((MAX_POWER/float64(transitionTime))*elapsed.Seconds()))
-			if power < 0 {
-				power = 0
-			}
-
-			// Set the new brightness
-			setGlow(power)
-
-			// If we have complete our fadeIn calculate next fadeIn
-			if power <= 0 {
-				fadeOutTime = astrotime.NextSunrise(time.Now(), cfg.Settings.Latitude, cfg.Settings.Longitude).Add(-transitionDuration/2)
-				log.Printf("The next fadeOut is %02d:%02d:%02d on %d/%d/%d", fadeOutTime.Hour(), fadeOutTime.Minute(), fadeOutTime.Second(), fadeOutTime.Month(), fadeOutTime.Day(), fadeOutTime.Year())
-			}
-		}
+	// Stop on a signal, also while still waiting to start
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	initInterrupt(cancel)
+
+	// Run every device until we get a signal to stop
+	ctls := &controllers{}
+	initSignal(ctls)
+	var running sync.WaitGroup
+	for _, device := range runDevices(cfg) {
+		running.Add(1)
+		go func(device string) {
+			defer running.Done()
+			runDevice(ctx, cfg, device, logBuffer, ctls)
+		}(device)
 	}
+	running.Wait()
 }
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// On a first deploy the directories of the log and the PID file are not there yet
+func TestCreatesMissingDirectories(t *testing.T) {
+	dir := t.TempDir()
+
+	logPath := filepath.Join(dir, "var", "log", "piglow", "ambient.log")
+	logFile, err := openLogFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logFile.Close()
+	if info, err := os.Stat(filepath.Dir(logPath)); err != nil || info.Mode().Perm() != 0750 {
+		t.Fatalf("log directory %v: %v", info, err)
+	}
+
+	pidPath := filepath.Join(dir, "run", "piglow", "ambient.pid")
+	if err := writePidFile(pidPath); err != nil {
+		t.Fatal(err)
+	}
+	if pid, err := ioutil.ReadFile(pidPath); err != nil || string(pid) != strconv.Itoa(os.Getpid()) {
+		t.Fatalf("PID file has %q: %v", pid, err)
+	}
+}
+
+// A directory that cannot be created is named in the error
+func TestLogDirectoryError(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openLogFile(filepath.Join(file, "logs", "ambient.log")); err == nil || !strings.Contains(err.Error(), "log directory") {
+		t.Fatalf("got %v, expected the log directory to fail", err)
+	}
+	if err := writePidFile(filepath.Join(file, "run", "ambient.pid")); err == nil {
+		t.Fatal("no error for a PID file under a file")
+	}
+}
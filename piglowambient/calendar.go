@@ -0,0 +1,132 @@
+package piglowambient
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const CALENDAR_DAYS = 7
+const CALENDAR_TIME = "20060102T150405Z"
+
+// A fade or twilight phase in the calendar, without an end for something that happens at once
+type calendarEvent struct {
+	start time.Time
+	end time.Time
+	summary string
+	description string
+}
+
+// Write the fades (or the twilight phases) of the coming week as an iCalendar file
+func (c *Controller) WriteCalendar(path string, start time.Time) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := c.writeCalendar(file, start); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+func (c *Controller) writeCalendar(out io.Writer, start time.Time) error {
+	w := bufio.NewWriter(out)
+	line := func(format string, args ...interface{}) {
+		w.WriteString(foldCalendarLine(fmt.Sprintf(format, args...)) + "\r\n")
+	}
+
+	line("BEGIN:VCALENDAR")
+	line("VERSION:2.0")
+	line("PRODID:-//piglow-ambient//schedule//EN")
+	line("CALSCALE:GREGORIAN")
+	stamp := time.Now().UTC().Format(CALENDAR_TIME)
+	for _, event := range c.calendarEvents(start, start.AddDate(0, 0, CALENDAR_DAYS)) {
+		line("BEGIN:VEVENT")
+		line("UID:%d-%s@piglow-ambient", event.start.Unix(), strings.Replace(strings.ToLower(event.summary), " ", "-", -1))
+		line("DTSTAMP:%s", stamp)
+		line("DTSTART:%s", event.start.UTC().Format(CALENDAR_TIME))
+		if event.end.After(event.start) {
+			line("DTEND:%s", event.end.UTC().Format(CALENDAR_TIME))
+		}
+		line("SUMMARY:%s", escapeCalendarText(event.summary))
+		line("DESCRIPTION:%s", escapeCalendarText(event.description))
+		line("END:VEVENT")
+	}
+	line("END:VCALENDAR")
+	return w.Flush()
+}
+
+// The events between from and to the schedule would run, a curve follows the clock so it has none
+func (c *Controller) calendarEvents(from time.Time, to time.Time) []calendarEvent {
+	var events []calendarEvent
+	if len(c.curve) > 0 {
+		return events
+	}
+
+	// Every night from sunset to sunrise, one event per twilight phase
+	if len(c.cfg.Twilight) > 0 {
+		for sunset := c.previousSunset(from); sunset.Before(to); sunset = later(sunset, c.nextSunset(sunset.Add(time.Minute))) {
+			points := c.twilightPoints(sunset.Add(time.Minute))
+			for i := 0; i < len(points) - 1; i++ {
+				if !points[i + 1].time.After(from) || !points[i].time.Before(to) || !c.inSeason(points[i].time) {
+					continue
+				}
+				events = append(events, calendarEvent{start: points[i].time, end: points[i + 1].time,
+					summary: "PiGlow " + points[i].name,
+					description: fmt.Sprintf("Brightness %d to %d", points[i].power, points[i + 1].power)})
+			}
+		}
+		return events
+	}
+
+	if c.events() != "sunrise" {
+		for fadeIn := c.nextFadeIn(from); fadeIn.Before(to); fadeIn = later(fadeIn, c.nextFadeIn(fadeIn.Add(time.Minute))) {
+			if c.inSeason(fadeIn) {
+				events = append(events, calendarEvent{start: fadeIn, end: fadeIn.Add(time.Duration(c.fadeInSeconds()) * time.Second),
+					summary: "PiGlow fade in", description: fmt.Sprintf("Fading in to brightness %d", c.holdPower())})
+			}
+		}
+	}
+	if c.events() != "sunset" {
+		for fadeOut := c.nextFadeOut(from); fadeOut.Before(to); fadeOut = later(fadeOut, c.nextFadeOut(fadeOut.Add(time.Minute))) {
+			if c.inSeason(fadeOut) {
+				events = append(events, calendarEvent{start: fadeOut, end: fadeOut.Add(time.Duration(c.fadeOutSeconds()) * time.Second),
+					summary: "PiGlow fade out", description: "Fading out to brightness 0"})
+			}
+		}
+	}
+	return events
+}
+
+// The next event, or a day later when the sun did not give one after the previous event (e.g. a polar night)
+func later(previous time.Time, next time.Time) time.Time {
+	if !next.After(previous) {
+		return previous.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// Text values have their backslashes, commas, semicolons and newlines escaped
+func escapeCalendarText(text string) string {
+	return strings.NewReplacer("\\", "\\\\", ",", "\\,", ";", "\\;", "\n", "\\n").Replace(text)
+}
+
+// Lines of more than 75 octets go on in lines starting with a space
+func foldCalendarLine(line string) string {
+	var folded strings.Builder
+	length := 0
+	for _, r := range line {
+		if size := len(string(r)); length + size > 75 {
+			folded.WriteString("\r\n ")
+			length = 1
+		}
+		folded.WriteRune(r)
+		length += len(string(r))
+	}
+	return folded.String()
+}
@@ -0,0 +1,69 @@
+package piglowambient
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEscapeCalendarText(t *testing.T) {
+	tests := []struct {
+		text, escaped string
+	}{
+		{"PiGlow fade in", "PiGlow fade in"},
+		{"Brightness 0, then 255; done", "Brightness 0\\, then 255\\; done"},
+		{"C:\\piglow", "C:\\\\piglow"},
+		{"two\nlines", "two\\nlines"},
+		{"\\,", "\\\\\\,"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if escaped := escapeCalendarText(test.text); escaped != test.escaped {
+			t.Errorf("`%s`: got `%s`, expected `%s`", test.text, escaped, test.escaped)
+		}
+	}
+}
+
+func TestFoldCalendarLine(t *testing.T) {
+	tests := []struct {
+		line, folded string
+	}{
+		{"", ""},
+		{"SUMMARY:PiGlow", "SUMMARY:PiGlow"},
+		{strings.Repeat("a", 75), strings.Repeat("a", 75)},
+		{strings.Repeat("a", 76), strings.Repeat("a", 75) + "\r\n a"},
+		{strings.Repeat("a", 150), strings.Repeat("a", 75) + "\r\n " + strings.Repeat("a", 74) + "\r\n a"},
+		// A character of several octets is never split
+		{strings.Repeat("a", 74) + "ø", strings.Repeat("a", 74) + "\r\n ø"},
+		{strings.Repeat("a", 73) + "ø", strings.Repeat("a", 73) + "ø"},
+	}
+	for _, test := range tests {
+		if folded := foldCalendarLine(test.line); folded != test.folded {
+			t.Errorf("`%s`: got `%q`, expected `%q`", test.line, folded, test.folded)
+		}
+	}
+}
+
+func TestWriteCalendar(t *testing.T) {
+	c, _ := newTestController(t, testConfig())
+	var out bytes.Buffer
+	if err := c.writeCalendar(&out, time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+
+	text := out.String()
+	if !strings.HasPrefix(text, "BEGIN:VCALENDAR\r\n") || !strings.HasSuffix(text, "END:VCALENDAR\r\n") {
+		t.Fatalf("not a calendar:\n%s", text)
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(text, "\r\n"), "\r\n") {
+		if len(line) > 75 {
+			t.Errorf("line of %d octets: %s", len(line), line)
+		}
+	}
+
+	// A fade in and a fade out every day of the week
+	if events := strings.Count(text, "BEGIN:VEVENT"); events != 2 * CALENDAR_DAYS {
+		t.Errorf("got %d events, expected %d", events, 2 * CALENDAR_DAYS)
+	}
+}
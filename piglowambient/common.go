@@ -0,0 +1,1297 @@
+package piglowambient
+
+import (
+	"code.google.com/p/gcfg"
+	"strings"
+	"strconv"
+	"errors"
+	"unicode"
+	"fmt"
+	"log"
+	"io/ioutil"
+	"regexp"
+	"path/filepath"
+	"sort"
+	"math"
+	"os"
+	"time"
+)
+
+const MAX_POWER = 255
+const INDICATOR_POWER = 64
+const LED_COUNT = 18
+const ARM_COUNT = 3
+const COLOUR_COUNT = 6
+const DITHER_LIMIT = 6
+const DITHER_INTERVAL = 10 * time.Millisecond
+const SUSPEND_THRESHOLD = time.Minute
+const CHASE_PERIOD = 12 * time.Second
+const CHASE_DEPTH = 0.3
+const CHASE_INTERVAL = 50 * time.Millisecond
+const RAMP_DURATION = 3 * time.Second
+const RAMP_STEP = 35 * time.Millisecond
+const PROFILE_NONE = "none"
+const TCP_CHECK_TIMEOUT = 5 * time.Second
+const PING_GRACE_INTERVAL = time.Second
+const LOG_CLOCK_FORMAT = "15:04:05 MST"
+const WRITE_RATE_SAMPLES = 20
+const WRITE_RATE_MARGIN = 0.8
+const MIN_UPDATE_INTERVAL = 10 * time.Millisecond
+
+// Colours in ring order from the outside in, LED n sits on arm n/6 and has colour n%6 (the numbering of SetLED)
+var colours = []string{"red", "orange", "yellow", "green", "blue", "white"}
+
+// Brightness of every LED, what gets written to the PiGlow in one go
+type frame [LED_COUNT]uint8
+
+// Configuration as read from the gcfg file
+type Config struct {
+	Settings Settings
+
+	// Per device overrides of the settings, [Device "name"] sections
+	Device map[string]*Settings
+	Profile map[string]*Settings
+
+	// Overrides for the machine with that hostname, [Host "name"] sections
+	Host map[string]*Settings
+
+	// Calibration of the colours
+	Colors Colors
+
+	// Brightness by the clock instead of the sun
+	Curve Curve
+
+	// How the PiGlow is mounted
+	Layout Layout
+
+	// Brightness by the twilights instead of a single fade, [Twilight "civil"] sections
+	Twilight map[string]*Twilight
+}
+
+// Physical LED of every logical one, the [Layout] section as `Order = 6 7 8 ...` with the physical index of logical
+// LED 0 first, empty for the order of the library
+type Layout struct {
+	Order string
+}
+
+// Control points of the [Curve] section, as `Point = HH:MM brightness`
+type Curve struct {
+	Point []string
+}
+
+// Brightness at a time of day, in seconds since midnight
+type curvePoint struct {
+	second int
+	power int
+}
+
+// Calibration per colour, the [Colors] section
+type Colors struct {
+	WhiteMax Brightness
+	BlueMax Brightness
+	GreenMax Brightness
+	YellowMax Brightness
+	OrangeMax Brightness
+	RedMax Brightness
+
+	// Gamma of all colours and per colour, zero for the one of all colours
+	Gamma float64
+	WhiteGamma float64
+	BlueGamma float64
+	GreenGamma float64
+	YellowGamma float64
+	OrangeGamma float64
+	RedGamma float64
+}
+
+// Maximum brightness of every colour in ring order
+func (colors *Colors) maxima() [COLOUR_COUNT]int {
+	return [COLOUR_COUNT]int{int(colors.RedMax), int(colors.OrangeMax), int(colors.YellowMax), int(colors.GreenMax), int(colors.BlueMax), int(colors.WhiteMax)}
+}
+
+// What every level of every colour is written as, worked out once instead of a math.Pow per LED on every write
+type calibration [COLOUR_COUNT][MAX_POWER + 1]uint8
+
+// The gamma correction (a gamma of 1 leaves the level as it is) and then the maximum of the colour
+func (colors *Colors) calibration() *calibration {
+	var table calibration
+	gammas := colors.gammas()
+	maxima := colors.maxima()
+	for ring := range table {
+		for level := range table[ring] {
+			value := uint8(level)
+			if gamma := gammas[ring]; gamma != 1 {
+				value = uint8(math.Round(MAX_POWER * math.Pow(float64(level) / MAX_POWER, gamma)))
+			}
+			if max := uint8(maxima[ring]); value > max {
+				value = max
+			}
+			table[ring][level] = value
+		}
+	}
+	return &table
+}
+
+// Gamma of every colour in ring order
+func (colors *Colors) gammas() [COLOUR_COUNT]float64 {
+	gammas := [COLOUR_COUNT]float64{colors.RedGamma, colors.OrangeGamma, colors.YellowGamma, colors.GreenGamma, colors.BlueGamma, colors.WhiteGamma}
+	for ring := range gammas {
+		if gammas[ring] == 0 {
+			gammas[ring] = colors.Gamma
+		}
+	}
+	return gammas
+}
+
+// Everything that can be set in the [Settings] section (and overridden per device)
+type Settings struct {
+	TransitionSpeed string
+	Latitude float64
+	Longitude float64
+	Coordinates string
+	PingIp string
+	PingDownThreshold int
+	PingUpThreshold int
+	StateFile string
+	PingGracePeriod string
+	MaxRuntime string
+	PingDownColour string
+	ConfigErrorColour string
+	GeoSource string
+	GpsdAddress string
+	NoonAccent Brightness
+	NoonAccentDuration string
+	GeoRetryInitial string
+	GeoRetryMax string
+	PingSource string
+	SunriseHook string
+	SunriseHookPower Brightness
+	SunriseHookTimeout string
+	SunriseHookRetry string
+	WebhookUrl string
+	FadeIn bool
+	FadeOut bool
+	UpdateInterval string
+	PingRequired bool
+	ControlSocket string
+	DryRunWithoutDevice bool
+	HttpAddress string
+	PreviewImage bool
+	Dither bool
+	FadeAlignment string
+	FallbackLatitude float64
+	FallbackLongitude float64
+	ActiveArm string
+	WriteCooldown string
+	StartupDelay string
+	HoldEffect string
+	BlueHour Brightness
+	BlueHourDuration string
+	MinOffWindow string
+	MinOnWindow string
+	DownColour string
+	DownColourPower Brightness
+	RampDuration string
+	CheckMode string
+	CheckPort int
+	IncludeDir string
+	PauseOnUp bool
+	ActiveMonths string
+	Events string
+	UnhealthyWhenDegraded bool
+	SleepWhenOff bool
+	FadeInEasing string
+	OvershootPeak Brightness
+	OvershootSettle string
+	LateNightDim string
+	HttpTimeout string
+	SimulateDuration string
+	WhiteBalance string
+	SleepUntilChange bool
+	PresenceSource string
+	PresenceInterval string
+	PresenceAwayPower Brightness
+	MinOnTime string
+	LogBufferLines int
+	MaxWriteRate float64
+	ReloadErrorBlink bool
+	SoftStart string
+	MaxSlewRate float64
+	PilotLED string
+	PilotBrightness Brightness
+	DoNotDisturb string
+	DisplayTimezone string
+}
+
+const (
+	PingUnknown = iota
+	PingUp
+	PingDown
+	PingDisabled
+)
+
+// Abnormal states shown by blinking a colour
+const (
+	StatusPingDown = iota
+	StatusConfigError
+)
+
+// Keeps track of consecutive ping results so a single lost ping does not flip the state
+type pingTracker struct {
+	state int
+	upCount int
+	downCount int
+}
+
+// Record a ping result, returns true when the state changed because a threshold was crossed
+func (t *pingTracker) record(isUp bool, upThreshold int, downThreshold int) bool {
+	if upThreshold < 1 {
+		upThreshold = 1
+	}
+	if downThreshold < 1 {
+		downThreshold = 1
+	}
+
+	if isUp {
+		t.upCount++
+		t.downCount = 0
+		if t.state != PingUp && t.upCount >= upThreshold {
+			t.state = PingUp
+			return true
+		}
+	} else {
+		t.downCount++
+		t.upCount = 0
+		if t.state != PingDown && t.downCount >= downThreshold {
+			t.state = PingDown
+			return true
+		}
+	}
+	return false
+}
+
+// Brightness after the given time into a fade in of transitionTime seconds, with a maximum of 255
+func computeFadeInPower(elapsed time.Duration, transitionTime int) int {
+	if transitionTime <= 0 {
+		return MAX_POWER
+	}
+	return int(math.Round(fadeInLevel(elapsed, transitionTime)))
+}
+
+// Brightness after the given time into a fade out of transitionTime seconds, with a minimum of zero
+func computeFadeOutPower(elapsed time.Duration, transitionTime int) int {
+	// The mirror image of the fade in
+	return MAX_POWER - computeFadeInPower(elapsed, transitionTime)
+}
+
+// Exact brightness during a fade in, without rounding to what the PiGlow can show
+func fadeInLevel(elapsed time.Duration, transitionTime int) float64 {
+	if transitionTime <= 0 {
+		return MAX_POWER
+	}
+	return math.Max(0, math.Min(MAX_POWER, MAX_POWER/float64(transitionTime)*elapsed.Seconds()))
+}
+
+// Exact brightness during a fade out, without rounding to what the PiGlow can show
+func fadeOutLevel(elapsed time.Duration, transitionTime int) float64 {
+	if transitionTime <= 0 {
+		return 0
+	}
+	return math.Max(0, MAX_POWER-MAX_POWER/float64(transitionTime)*elapsed.Seconds())
+}
+
+// Brightness of a fade in that rises to full brightness and then settles the peak brightness steps lower, settling
+// is how far past the end of the rise we are
+func overshootLevel(level float64, settling time.Duration, settle time.Duration, peak int) float64 {
+	if settling <= 0 {
+		return level
+	}
+	if settling >= settle {
+		return float64(MAX_POWER - peak)
+	}
+	// Ease into the hold brightness instead of dropping
+	progress := settling.Seconds() / settle.Seconds()
+	return MAX_POWER - float64(peak) * progress * progress * (3 - 2 * progress)
+}
+
+// Exponential backoff for retrying a failing network integration without hammering it
+type backoff struct {
+	initial time.Duration
+	max time.Duration
+	current time.Duration
+}
+
+// Backoff starting at initial and doubling up to max, zero values get a default of a minute and an hour
+func newBackoff(initial time.Duration, max time.Duration) *backoff {
+	if initial <= 0 {
+		initial = time.Minute
+	}
+	if max < initial {
+		max = time.Hour
+		if max < initial {
+			max = initial
+		}
+	}
+	return &backoff{initial: initial, max: max}
+}
+
+// Interval to wait before the next attempt
+func (b *backoff) next() time.Duration {
+	if b.current == 0 {
+		b.current = b.initial
+		return b.current
+	}
+
+	b.current *= 2
+	if b.current > b.max {
+		b.current = b.max
+	}
+	return b.current
+}
+
+// Start over at the initial interval after a success
+func (b *backoff) reset() {
+	b.current = 0
+}
+
+// Configuration with the defaults that are not the zero value, the file is read on top of it
+func DefaultConfig() Config {
+	var conf Config
+	conf.Settings.FadeIn = true
+	conf.Settings.FadeOut = true
+	conf.Settings.DownColourPower = 16
+	conf.Settings.OvershootPeak = 32
+	conf.Settings.OvershootSettle = "5m"
+	conf.Settings.PilotBrightness = 8
+	conf.Colors = Colors{WhiteMax: MAX_POWER, BlueMax: MAX_POWER, GreenMax: MAX_POWER, YellowMax: MAX_POWER, OrangeMax: MAX_POWER, RedMax: MAX_POWER, Gamma: 1}
+	return conf
+}
+
+// Coordinates copied with a decimal comma (e.g. Latitude = 52,37) do not parse as a float
+var decimalComma = regexp.MustCompile(`(?im)^(\s*(?:fallback)?(?:latitude|longitude)\s*=\s*"?-?\d+),(\d+"?\s*)$`)
+
+// Coordinates on one line the way a map app gives them, e.g. 52.37, 4.90 or 52.37N 4.90E or 52,37 4,90
+var coordinatesString = regexp.MustCompile(`(?i)^\s*([NS])?\s*([+-]?\d+(?:[.,]\d+)?)\s*°?\s*([NS])?\s*[,;\s]\s*([EW])?\s*([+-]?\d+(?:[.,]\d+)?)\s*°?\s*([EW])?\s*$`)
+
+// Replace the latitude and longitude by the Coordinates when given, cleared after so a section that inherits these
+// settings can still set its own Latitude and Longitude
+func (s *Settings) applyCoordinates() error {
+	if strings.TrimSpace(s.Coordinates) == "" {
+		return nil
+	}
+	latitude, longitude, err := parseCoordinates(s.Coordinates)
+	if err != nil {
+		return err
+	}
+	s.Latitude = latitude
+	s.Longitude = longitude
+	s.Coordinates = ""
+	return nil
+}
+
+func parseCoordinates(str string) (float64, float64, error) {
+	match := coordinatesString.FindStringSubmatch(str)
+	if match == nil || (match[1] != "" && match[3] != "") || (match[4] != "" && match[6] != "") {
+		return 0, 0, fmt.Errorf("Coordinates `%s` given, has to be a latitude and a longitude like 52.37, 4.90", str)
+	}
+	latitude, _ := strconv.ParseFloat(strings.Replace(match[2], ",", ".", 1), 64)
+	longitude, _ := strconv.ParseFloat(strings.Replace(match[5], ",", ".", 1), 64)
+
+	// South and west are negative
+	if strings.EqualFold(match[1] + match[3], "s") {
+		latitude = -math.Abs(latitude)
+	}
+	if strings.EqualFold(match[4] + match[6], "w") {
+		longitude = -math.Abs(longitude)
+	}
+	if err := checkCoordinates(latitude, longitude); err != nil {
+		return 0, 0, fmt.Errorf("Coordinates `%s` given: %s", str, err)
+	}
+	return latitude, longitude, nil
+}
+
+// Use a decimal point for coordinates written with a comma
+func fixDecimalCommas(text string) string {
+	return decimalComma.ReplaceAllStringFunc(text, func(line string) string {
+		fixed := decimalComma.ReplaceAllString(line, "${1}.${2}")
+		log.Printf("Warning: reading `%s` as `%s`, use a decimal point", strings.TrimSpace(line), strings.TrimSpace(fixed))
+		return fixed
+	})
+}
+
+// Contents of a configuration file, ready for gcfg
+func readConfigText(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read gcfg data: %s", err)
+	}
+	return fixDecimalCommas(string(data)), nil
+}
+
+// Read the main file and the drop-in files again over what was read before
+func readConfigTexts(conf *Config, names []string, texts []string) error {
+	conf.Curve.Point = nil // Would be read twice otherwise
+	for i, text := range texts {
+		if err := gcfg.ReadStringInto(conf, text); err != nil {
+			return fmt.Errorf("Failed to parse gcfg data in %s: %s", names[i], err)
+		}
+	}
+	return nil
+}
+
+// Name of this machine for the [Host] sections, a variable so the tests can be another machine
+var lookupHostname = os.Hostname
+
+// Read and validate a configuration file, together with the drop-in files of the IncludeDir
+func ReadConfigFile(path string) (Config, error) {
+	conf := DefaultConfig()
+	text, err := readConfigText(path)
+	if err != nil {
+		return conf, err
+	}
+	if err := gcfg.ReadStringInto(&conf, text); err != nil {
+		return conf, fmt.Errorf("Failed to parse gcfg data: %s", err)
+	}
+
+	// Drop-in files go over the main file in alphabetical order, the last one wins
+	names := []string{path}
+	texts := []string{text}
+	if conf.Settings.IncludeDir != "" {
+		includes, err := filepath.Glob(filepath.Join(conf.Settings.IncludeDir, "*.gcfg"))
+		if err != nil {
+			return conf, fmt.Errorf("Failed to list include directory: %s", err)
+		}
+		sort.Strings(includes)
+		for _, include := range includes {
+			text, err := readConfigText(include)
+			if err != nil {
+				return conf, err
+			}
+			if err := gcfg.ReadStringInto(&conf, text); err != nil {
+				return conf, fmt.Errorf("Failed to parse gcfg data in %s: %s", include, err)
+			}
+			log.Printf("Merged configuration from %s", include)
+			names = append(names, include)
+			texts = append(texts, text)
+		}
+	}
+
+	if err := conf.Settings.applyCoordinates(); err != nil {
+		return conf, err
+	}
+
+	// The section of our host goes over the top-level settings, read again with it starting out as them so it only
+	// overrides what it sets
+	if len(conf.Host) > 0 {
+		hostname, err := lookupHostname()
+		if _, ok := conf.Host[hostname]; err == nil && ok {
+			settings := conf.Settings
+			conf.Host[hostname] = &settings
+			if err := readConfigTexts(&conf, names, texts); err != nil {
+				return conf, err
+			}
+			conf.Settings = *conf.Host[hostname]
+			if err := conf.Settings.applyCoordinates(); err != nil {
+				return conf, fmt.Errorf("Host %s: %s", hostname, err)
+			}
+			log.Printf("Using the settings of host %s", hostname)
+		} else {
+			log.Printf("No host section for %s, using the top-level settings", hostname)
+		}
+	}
+
+	// Read again with every device and profile section starting out as the top-level settings, so they only override
+	// what they set
+	if len(conf.Device) > 0 || len(conf.Profile) > 0 {
+		base := conf.Settings
+		for name := range conf.Device {
+			settings := base
+			conf.Device[name] = &settings
+		}
+		for name := range conf.Profile {
+			settings := base
+			conf.Profile[name] = &settings
+		}
+		if err := readConfigTexts(&conf, names, texts); err != nil {
+			return conf, err
+		}
+		conf.Settings = base // The top-level settings are read again without the host section
+		for name, settings := range conf.Device {
+			if err := settings.applyCoordinates(); err != nil {
+				return conf, fmt.Errorf("Device %s: %s", name, err)
+			}
+		}
+		for name, settings := range conf.Profile {
+			if err := settings.applyCoordinates(); err != nil {
+				return conf, fmt.Errorf("Profile %s: %s", name, err)
+			}
+		}
+	}
+
+	if err := validateConfig(&conf); err != nil {
+		return conf, err
+	}
+	for _, name := range conf.DeviceNames() {
+		device := conf.ForDevice(name)
+		if err := validateConfig(&device); err != nil {
+			return conf, fmt.Errorf("Device %s: %s", name, err)
+		}
+	}
+	if err := checkDevicesApart(&conf); err != nil {
+		return conf, err
+	}
+	for name := range conf.Profile {
+		if strings.ToLower(name) == PROFILE_NONE {
+			return conf, fmt.Errorf("Profile name `%s` is reserved", name)
+		}
+		profile := conf.ForProfile(name)
+		if err := validateConfig(&profile); err != nil {
+			return conf, fmt.Errorf("Profile %s: %s", name, err)
+		}
+	}
+	return conf, nil
+}
+
+// Every device runs a controller of its own, they cannot share a control socket, an HTTP address or a state file
+func checkDevicesApart(conf *Config) error {
+	used := make(map[string]string)
+	for _, name := range conf.DeviceNames() {
+		settings := conf.Device[name]
+		apart := []struct{ setting, value string }{
+			{"ControlSocket", settings.ControlSocket},
+			{"HttpAddress", settings.HttpAddress},
+			{"StateFile", settings.StateFile},
+		}
+		for _, a := range apart {
+			if a.value == "" {
+				continue
+			}
+			key := a.setting + " " + a.value
+			if other, ok := used[key]; ok {
+				return fmt.Errorf("Devices %s and %s both have %s `%s`, every device needs its own", other, name, a.setting, a.value)
+			}
+			used[key] = name
+		}
+	}
+	return nil
+}
+
+// Configuration with the top-level settings replaced by a [Profile "name"] section, unchanged for an unknown (or
+// empty) name
+func (conf *Config) ForProfile(name string) Config {
+	profiled := *conf
+	if settings, ok := conf.Profile[name]; ok {
+		profiled.Settings = *settings
+	}
+	return profiled
+}
+
+// Names of the device sections in alphabetical order
+func (conf *Config) DeviceNames() []string {
+	var names []string
+	for name := range conf.Device {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Configuration for a single device, the top-level configuration for an unknown (or empty) name
+func (conf *Config) ForDevice(name string) Config {
+	settings, ok := conf.Device[name]
+	if !ok {
+		return Config{Settings: conf.Settings, Colors: conf.Colors, Curve: conf.Curve, Layout: conf.Layout, Twilight: conf.Twilight}
+	}
+	return Config{Settings: *settings, Colors: conf.Colors, Curve: conf.Curve, Layout: conf.Layout, Twilight: conf.Twilight}
+}
+
+// A brightness in the configuration, the raw 0 to 255 or a percentage of full brightness like 50%
+type Brightness int
+
+func (b *Brightness) UnmarshalText(text []byte) error {
+	value, err := parseBrightness(string(text))
+	if err != nil {
+		return err
+	}
+	*b = Brightness(value)
+	return nil
+}
+
+// Raw brightness of a raw value or a percentage, rounded to the nearest raw value. Whether a raw value is in range
+// is up to the setting.
+func parseBrightness(str string) (int, error) {
+	str = strings.TrimSpace(str)
+	if strings.HasSuffix(str, "%") {
+		percentage, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(str, "%")), 64)
+		if err != nil || !(percentage >= 0 && percentage <= 100) {
+			return 0, fmt.Errorf("Brightness `%s` given, a percentage has to be between 0%% and 100%%", str)
+		}
+		return int(math.Round(percentage * MAX_POWER / 100)), nil
+	}
+	value, err := strconv.Atoi(str)
+	if err != nil {
+		return 0, fmt.Errorf("Brightness `%s` given, has to be 0 to %d or a percentage", str, MAX_POWER)
+	}
+	return value, nil
+}
+
+// Check the configuration for values we cannot run with
+func validateConfig(conf *Config) error {
+	transitionTime, err := getTransitionSpeed(conf.Settings.TransitionSpeed)
+	if err != nil {
+		return err
+	}
+	if transitionTime < 0 {
+		return errors.New("Need to have a transition period that is zero (switch instantly) or greater!")
+	}
+
+	updateInterval, err := getDuration(conf.Settings.UpdateInterval)
+	if err != nil {
+		return fmt.Errorf("Invalid update interval: %s", err)
+	}
+	if updateInterval < 0 {
+		return errors.New("Need to have an update interval that is greater then zero!")
+	}
+
+	// Bad coordinates are only fatal when there is nothing to fall back to
+	if conf.hasFallbackCoordinates() {
+		if err := checkCoordinates(conf.Settings.FallbackLatitude, conf.Settings.FallbackLongitude); err != nil {
+			return fmt.Errorf("Invalid fallback coordinates: %s", err)
+		}
+	} else if err := checkCoordinates(conf.Settings.Latitude, conf.Settings.Longitude); err != nil && !coordinatesMissing(conf.Settings.Latitude, conf.Settings.Longitude) {
+		return err
+	}
+
+	if _, err := getWhiteBalance(conf.Settings.WhiteBalance); err != nil {
+		return err
+	}
+	if _, err := getActiveArm(conf.Settings.ActiveArm); err != nil {
+		return err
+	}
+	pilot, err := getPilotLeds(conf.Settings.PilotLED)
+	if err != nil {
+		return err
+	}
+	if len(pilot) > 0 && conf.Settings.SleepWhenOff {
+		return errors.New("A pilot light keeps the PiGlow lit, it cannot sleep with SleepWhenOff!")
+	}
+	if conf.Settings.PilotBrightness < 0 || conf.Settings.PilotBrightness > MAX_POWER {
+		return fmt.Errorf("Pilot brightness is %d, but has to be between 0 and %d", conf.Settings.PilotBrightness, MAX_POWER)
+	}
+	if _, _, _, err := getDoNotDisturb(conf.Settings.DoNotDisturb); err != nil {
+		return err
+	}
+	if _, err := getDisplayTimezone(conf.Settings.DisplayTimezone); err != nil {
+		return err
+	}
+
+	writeCooldown, err := getDuration(conf.Settings.WriteCooldown)
+	if err != nil {
+		return fmt.Errorf("Invalid write cooldown: %s", err)
+	}
+	if writeCooldown < 0 {
+		return errors.New("Need to have a write cooldown that is zero or greater!")
+	}
+
+	if _, err := getDuration(conf.Settings.StartupDelay); err != nil {
+		return fmt.Errorf("Invalid startup delay: %s", err)
+	}
+
+	minOff, err := getDuration(conf.Settings.MinOffWindow)
+	if err != nil {
+		return fmt.Errorf("Invalid minimum off window: %s", err)
+	}
+	minOn, err := getDuration(conf.Settings.MinOnWindow)
+	if err != nil {
+		return fmt.Errorf("Invalid minimum on window: %s", err)
+	}
+	if (minOff > 0 || minOn > 0) && minOff + minOn + 2 * time.Duration(transitionTime) * time.Second > 24 * time.Hour {
+		return errors.New("The minimum off and on windows and two transitions do not fit in a day!")
+	}
+	if minOff == 0 && minOn == 0 && fadesAlwaysOverlap(conf, time.Duration(transitionTime) * time.Second) {
+		return errors.New("The transition is longer than both the day and the night all year round here, so the lights would never stop fading! Use a shorter transition or a MinOffWindow/MinOnWindow")
+	}
+
+	if conf.Settings.DownColour != "" {
+		var f frame
+		if err := f.setColour(strings.ToLower(conf.Settings.DownColour), 0); err != nil {
+			return err
+		}
+		if conf.Settings.DownColourPower < 0 || conf.Settings.DownColourPower > MAX_POWER {
+			return fmt.Errorf("Down colour power is %d, but has to be between 0 and %d", conf.Settings.DownColourPower, MAX_POWER)
+		}
+	}
+
+	if _, err := getDuration(conf.Settings.RampDuration); err != nil {
+		return fmt.Errorf("Invalid ramp duration: %s", err)
+	}
+	if _, err := getDuration(conf.Settings.SunriseHookRetry); err != nil {
+		return fmt.Errorf("Invalid sunrise hook retry: %s", err)
+	}
+	if _, err := getDuration(conf.Settings.SoftStart); err != nil {
+		return fmt.Errorf("Invalid soft start: %s", err)
+	}
+	if conf.Settings.MaxSlewRate < 0 {
+		return fmt.Errorf("Maximum slew rate is %f, but cannot be negative", conf.Settings.MaxSlewRate)
+	}
+	if _, err := getDuration(conf.Settings.HttpTimeout); err != nil {
+		return fmt.Errorf("Invalid HTTP timeout: %s", err)
+	}
+	if _, err := getDuration(conf.Settings.SimulateDuration); err != nil {
+		return fmt.Errorf("Invalid simulate duration: %s", err)
+	}
+	if conf.Settings.LogBufferLines < 0 {
+		return fmt.Errorf("Log buffer lines is %d, but cannot be negative", conf.Settings.LogBufferLines)
+	}
+	if _, err := getDuration(conf.Settings.MinOnTime); err != nil {
+		return fmt.Errorf("Invalid minimum on time: %s", err)
+	}
+	if _, err := getDuration(conf.Settings.PresenceInterval); err != nil {
+		return fmt.Errorf("Invalid presence interval: %s", err)
+	}
+	if conf.Settings.PresenceAwayPower < 0 || conf.Settings.PresenceAwayPower > MAX_POWER {
+		return fmt.Errorf("Presence away power is %d, but has to be between 0 and %d", conf.Settings.PresenceAwayPower, MAX_POWER)
+	}
+
+	switch strings.ToLower(conf.Settings.FadeInEasing) {
+		case "", "linear":
+		case "overshoot":
+			if conf.Settings.OvershootPeak < 0 || conf.Settings.OvershootPeak > MAX_POWER {
+				return fmt.Errorf("Overshoot peak is %d, but has to be between 0 and %d", conf.Settings.OvershootPeak, MAX_POWER)
+			}
+			if _, err := getDuration(conf.Settings.OvershootSettle); err != nil {
+				return fmt.Errorf("Invalid overshoot settle time: %s", err)
+			}
+		default:
+			return fmt.Errorf("Fade in easing `%s` given, has to be linear or overshoot", conf.Settings.FadeInEasing)
+	}
+
+	switch strings.ToLower(conf.Settings.CheckMode) {
+		case "", "icmp":
+		case "tcp":
+			if conf.Settings.CheckPort <= 0 || conf.Settings.CheckPort > 65535 {
+				return errors.New("Need a CheckPort between 1 and 65535 to check over TCP!")
+			}
+		default:
+			return fmt.Errorf("Check mode `%s` given, has to be icmp or tcp", conf.Settings.CheckMode)
+	}
+
+	if _, _, err := getActiveMonths(conf.Settings.ActiveMonths); err != nil {
+		return err
+	}
+
+	switch strings.ToLower(conf.Settings.Events) {
+		case "", "both", "sunset", "sunrise":
+		default:
+			return fmt.Errorf("Events `%s` given, has to be both, sunset or sunrise", conf.Settings.Events)
+	}
+
+	switch strings.ToLower(conf.Settings.HoldEffect) {
+		case "", "none", "chase":
+		default:
+			return fmt.Errorf("Hold effect `%s` given, but is not supported", conf.Settings.HoldEffect)
+	}
+
+	switch strings.ToLower(conf.Settings.FadeAlignment) {
+		case "", "center", "before", "after":
+		default:
+			return fmt.Errorf("Invalid fade alignment `%s`, has to be center, before or after", conf.Settings.FadeAlignment)
+	}
+
+	if _, err := parseCurve(conf.Curve.Point); err != nil {
+		return err
+	}
+
+	if _, err := parseLateNightDim(conf.Settings.LateNightDim); err != nil {
+		return err
+	}
+
+	if _, err := parseLayout(conf.Layout.Order); err != nil {
+		return err
+	}
+	if err := validateTwilight(conf); err != nil {
+		return err
+	}
+
+	for ring, max := range conf.Colors.maxima() {
+		if max < 0 || max > MAX_POWER {
+			return fmt.Errorf("Maximum for %s is %d, but has to be between 0 and %d", colours[ring], max, MAX_POWER)
+		}
+	}
+	for ring, gamma := range conf.Colors.gammas() {
+		if gamma <= 0 {
+			return fmt.Errorf("Gamma for %s is %f, but has to be greater than zero", colours[ring], gamma)
+		}
+	}
+	return nil
+}
+
+// Coordinates sunrise and sunset can be calculated for
+func checkCoordinates(latitude float64, longitude float64) error {
+	if latitude < -90 || latitude > 90 {
+		return fmt.Errorf("Latitude %f is not between -90 and 90", latitude)
+	}
+	if longitude < -180 || longitude > 180 {
+		return fmt.Errorf("Longitude %f is not between -180 and 180", longitude)
+	}
+	if coordinatesMissing(latitude, longitude) {
+		return errors.New("Latitude or longitude is missing")
+	}
+	return nil
+}
+
+// An empty value is read as zero, nobody lives exactly on the equator or the prime meridian
+func coordinatesMissing(latitude float64, longitude float64) bool {
+	return latitude == 0 || longitude == 0
+}
+
+func (conf *Config) hasFallbackCoordinates() bool {
+	return conf.Settings.FallbackLatitude != 0 || conf.Settings.FallbackLongitude != 0
+}
+
+// Switch to the fallback coordinates when the configured (or looked up) ones are unusable, returns whether it did
+func applyFallbackCoordinates(conf *Config) bool {
+	err := checkCoordinates(conf.Settings.Latitude, conf.Settings.Longitude)
+	if err == nil {
+		return false
+	}
+	if !conf.hasFallbackCoordinates() {
+		log.Printf("Warning: %s, sunrise and sunset will be wrong", err)
+		return false
+	}
+
+	log.Printf("WARNING: %s, using the fallback coordinates latitude %f, longitude %f", err, conf.Settings.FallbackLatitude, conf.Settings.FallbackLongitude)
+	conf.Settings.Latitude = conf.Settings.FallbackLatitude
+	conf.Settings.Longitude = conf.Settings.FallbackLongitude
+	return true
+}
+
+// Whether anything the ping check uses differs between two configurations
+func pingSettingsChanged(a *Config, b *Config) bool {
+	return a.Settings.PingIp != b.Settings.PingIp ||
+		a.Settings.PingDownThreshold != b.Settings.PingDownThreshold ||
+		a.Settings.PingUpThreshold != b.Settings.PingUpThreshold ||
+		a.Settings.PingGracePeriod != b.Settings.PingGracePeriod ||
+		a.Settings.PingSource != b.Settings.PingSource ||
+		a.Settings.CheckMode != b.Settings.CheckMode ||
+		a.Settings.CheckPort != b.Settings.CheckPort ||
+		a.Settings.PauseOnUp != b.Settings.PauseOnUp
+}
+
+// Whether anything the presence checks use differs between two configurations
+func presenceSettingsChanged(a *Config, b *Config) bool {
+	return a.Settings.PresenceSource != b.Settings.PresenceSource ||
+		a.Settings.PresenceInterval != b.Settings.PresenceInterval ||
+		a.Settings.PresenceAwayPower != b.Settings.PresenceAwayPower
+}
+
+// Whether anything the fade times are calculated from differs between two configurations
+func scheduleSettingsChanged(a *Config, b *Config) bool {
+	return a.Settings.TransitionSpeed != b.Settings.TransitionSpeed ||
+		a.Settings.FadeIn != b.Settings.FadeIn ||
+		a.Settings.FadeOut != b.Settings.FadeOut ||
+		a.Settings.UpdateInterval != b.Settings.UpdateInterval ||
+		a.Settings.FadeAlignment != b.Settings.FadeAlignment ||
+		a.Settings.MinOffWindow != b.Settings.MinOffWindow ||
+		a.Settings.MinOnWindow != b.Settings.MinOnWindow ||
+		a.Settings.Latitude != b.Settings.Latitude ||
+		a.Settings.Longitude != b.Settings.Longitude ||
+		a.Settings.LateNightDim != b.Settings.LateNightDim ||
+		a.Settings.DisplayTimezone != b.Settings.DisplayTimezone ||
+		strings.Join(a.Curve.Point, ",") != strings.Join(b.Curve.Point, ",")
+}
+
+// Frame with all LEDs at the same brightness
+func uniformFrame(power int) frame {
+	var f frame
+	for i := range f {
+		f[i] = uint8(power)
+	}
+	return f
+}
+
+// Switch off every arm except the given one
+func (f *frame) onlyArm(arm int) {
+	for i := range f {
+		if i / COLOUR_COUNT != arm {
+			f[i] = 0
+		}
+	}
+}
+
+// Physical index of every logical LED, every LED has to be given exactly once
+func parseLayout(order string) ([LED_COUNT]int, error) {
+	var layout [LED_COUNT]int
+	fields := strings.FieldsFunc(order, func(r rune) bool { return r == ' ' || r == ',' || r == '\t' })
+	if len(fields) == 0 {
+		for i := range layout {
+			layout[i] = i
+		}
+		return layout, nil
+	}
+	if len(fields) != LED_COUNT {
+		return layout, fmt.Errorf("Layout order `%s` has %d LEDs, but has to have all %d", order, len(fields), LED_COUNT)
+	}
+
+	var seen [LED_COUNT]bool
+	for i, field := range fields {
+		led, err := strconv.Atoi(field)
+		if err != nil || led < 0 || led >= LED_COUNT {
+			return layout, fmt.Errorf("Layout order `%s` has LED `%s`, has to be between 0 and %d", order, field, LED_COUNT - 1)
+		}
+		if seen[led] {
+			return layout, fmt.Errorf("Layout order `%s` has LED %d more than once", order, led)
+		}
+		seen[led] = true
+		layout[i] = led
+	}
+	return layout, nil
+}
+
+// Control points of the curve, they have to be in order of the time of day
+func parseCurve(points []string) ([]curvePoint, error) {
+	var curve []curvePoint
+	for _, point := range points {
+		fields := strings.Fields(point)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Curve point `%s` given, has to be like 22:00 128", point)
+		}
+		clock, err := time.Parse("15:04", fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("Curve point `%s` has an invalid time: %s", point, err)
+		}
+		power, err := parseBrightness(fields[1])
+		if err != nil || power < 0 || power > MAX_POWER {
+			return nil, fmt.Errorf("Curve point `%s` has to have a brightness between 0 and %d (or 0%% and 100%%)", point, MAX_POWER)
+		}
+
+		second := clock.Hour() * 3600 + clock.Minute() * 60
+		if len(curve) > 0 && second <= curve[len(curve) - 1].second {
+			return nil, fmt.Errorf("Curve point `%s` is not after the one before it", point)
+		}
+		curve = append(curve, curvePoint{second: second, power: power})
+	}
+	return curve, nil
+}
+
+// Brightness on the curve at a moment, in between two points it goes in a straight line (from the last point of the
+// day over midnight to the first)
+func curvePower(curve []curvePoint, now time.Time) int {
+	if len(curve) == 1 {
+		return curve[0].power
+	}
+
+	const day = 24 * 3600
+	second := float64(now.Hour() * 3600 + now.Minute() * 60 + now.Second()) + float64(now.Nanosecond()) / 1e9
+	previous := curve[len(curve) - 1]
+	previousSecond := float64(previous.second - day)
+	for _, point := range curve {
+		if float64(point.second) > second {
+			fraction := (second - previousSecond) / (float64(point.second) - previousSecond)
+			return previous.power + int(math.Round(float64(point.power - previous.power) * fraction))
+		}
+		previous = point
+		previousSecond = float64(point.second)
+	}
+
+	// After the last point, on the way to the first one tomorrow
+	next := curve[0]
+	fraction := (second - previousSecond) / (float64(next.second + day) - previousSecond)
+	return previous.power + int(math.Round(float64(next.power - previous.power) * fraction))
+}
+
+// Points of the late night dimming as `22:00 100, 01:00 50`, the percentage of the brightness that is left at that
+// time of the night. The points go on over midnight, so every point is later in the night than the one before it.
+func parseLateNightDim(str string) ([]curvePoint, error) {
+	var points []curvePoint
+	if strings.TrimSpace(str) == "" {
+		return points, nil
+	}
+
+	const day = 24 * 3600
+	for _, point := range strings.Split(str, ",") {
+		fields := strings.Fields(point)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Late night dim point `%s` given, has to be like 01:00 50", strings.TrimSpace(point))
+		}
+		clock, err := time.Parse("15:04", fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("Late night dim point `%s` has an invalid time: %s", strings.TrimSpace(point), err)
+		}
+		percentage, err := strconv.Atoi(fields[1])
+		if err != nil || percentage < 0 || percentage > 100 {
+			return nil, fmt.Errorf("Late night dim point `%s` has to have a percentage between 0 and 100", strings.TrimSpace(point))
+		}
+
+		second := clock.Hour() * 3600 + clock.Minute() * 60
+		if len(points) > 0 {
+			// Past midnight the clock starts over, count on from the first point
+			for second <= points[len(points) - 1].second {
+				second += day
+			}
+			if second - points[0].second >= day {
+				return nil, fmt.Errorf("Late night dim points `%s` span more than a day", str)
+			}
+		}
+		points = append(points, curvePoint{second: second, power: percentage})
+	}
+	return points, nil
+}
+
+// Percentage of the brightness that is left at a time of the night, in between two points it goes in a straight
+// line. Before the first point nothing is dimmed, after the last one it stays at the last percentage until halfway
+// to the first point of the next night.
+func lateNightPercentage(points []curvePoint, now time.Time) float64 {
+	if len(points) == 0 {
+		return 100
+	}
+
+	const day = 24 * 3600
+	second := float64(now.Hour() * 3600 + now.Minute() * 60 + now.Second()) + float64(now.Nanosecond()) / 1e9
+	first := float64(points[0].second)
+	for second < first {
+		second += day
+	}
+
+	last := points[len(points) - 1]
+	if second > float64(last.second) {
+		if second - float64(last.second) < (first + day - float64(last.second)) / 2 {
+			return float64(last.power)
+		}
+		return 100
+	}
+	for i := 1; i < len(points); i++ {
+		if second <= float64(points[i].second) {
+			previous := points[i - 1]
+			fraction := (second - float64(previous.second)) / float64(points[i].second - previous.second)
+			return float64(previous.power) + float64(points[i].power - previous.power) * fraction
+		}
+	}
+	return float64(points[0].power)
+}
+
+// First and last month of the season the lights are used in (e.g. 10-03 for October through March), 0 when always
+func getActiveMonths(str string) (int, int, error) {
+	str = strings.TrimSpace(str)
+	if str == "" {
+		return 0, 0, nil
+	}
+	parts := strings.Split(str, "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("Active months `%s` given, has to be like 10-03", str)
+	}
+	from, errFrom := strconv.Atoi(strings.TrimSpace(parts[0]))
+	to, errTo := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if errFrom != nil || errTo != nil || from < 1 || from > 12 || to < 1 || to > 12 {
+		return 0, 0, fmt.Errorf("Active months `%s` given, months have to be 1 to 12", str)
+	}
+	return from, to, nil
+}
+
+// Whether a month is in the season, which may wrap around the new year
+func monthActive(month time.Month, from int, to int) bool {
+	if from == 0 {
+		return true
+	}
+	if from <= to {
+		return int(month) >= from && int(month) <= to
+	}
+	return int(month) >= from || int(month) <= to
+}
+
+// The arm the schedule is shown on, -1 for all of them
+func getActiveArm(str string) (int, error) {
+	str = strings.ToLower(strings.TrimSpace(str))
+	if str == "" || str == "all" {
+		return -1, nil
+	}
+	arm, err := strconv.Atoi(str)
+	if err != nil || arm < 0 || arm >= ARM_COUNT {
+		return 0, fmt.Errorf("Active arm `%s` given, has to be all or 0 to %d", str, ARM_COUNT - 1)
+	}
+	return arm, nil
+}
+
+// Start and end of the do not disturb window in seconds since midnight (e.g. 23:30-06:00), ok is false without one
+func getDoNotDisturb(str string) (int, int, bool, error) {
+	str = strings.TrimSpace(str)
+	if str == "" {
+		return 0, 0, false, nil
+	}
+	parts := strings.Split(str, "-")
+	if len(parts) != 2 {
+		return 0, 0, false, fmt.Errorf("Do not disturb `%s` given, has to be a start and end time like 23:30-06:00", str)
+	}
+	start, errStart := time.Parse("15:04", strings.TrimSpace(parts[0]))
+	end, errEnd := time.Parse("15:04", strings.TrimSpace(parts[1]))
+	if errStart != nil || errEnd != nil || start.Equal(end) {
+		return 0, 0, false, fmt.Errorf("Do not disturb `%s` given, has to be a start and end time like 23:30-06:00", str)
+	}
+	return start.Hour() * 3600 + start.Minute() * 60, end.Hour() * 3600 + end.Minute() * 60, true, nil
+}
+
+// LEDs of the pilot light, a single LED (0 to 17) or a whole arm (arm 0 to arm 2), none when empty
+func getPilotLeds(str string) ([]int, error) {
+	str = strings.ToLower(strings.TrimSpace(str))
+	if str == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(str, "arm") {
+		arm, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(str, "arm")))
+		if err != nil || arm < 0 || arm >= ARM_COUNT {
+			return nil, fmt.Errorf("Pilot LED `%s` given, an arm has to be arm 0 to arm %d", str, ARM_COUNT - 1)
+		}
+		var leds []int
+		for ring := 0; ring < COLOUR_COUNT; ring++ {
+			leds = append(leds, arm*COLOUR_COUNT+ring)
+		}
+		return leds, nil
+	}
+	led, err := strconv.Atoi(str)
+	if err != nil || led < 0 || led >= LED_COUNT {
+		return nil, fmt.Errorf("Pilot LED `%s` given, has to be an LED from 0 to %d or an arm like arm 0", str, LED_COUNT - 1)
+	}
+	return []int{led}, nil
+}
+
+// Timezone the times in the log lines and the status are shown in, nil for the local one when empty
+func getDisplayTimezone(str string) (*time.Location, error) {
+	str = strings.TrimSpace(str)
+	if str == "" {
+		return nil, nil
+	}
+	location, err := time.LoadLocation(str)
+	if err != nil {
+		return nil, fmt.Errorf("Display timezone `%s` given, has to be a name like Europe/Amsterdam: %s", str, err)
+	}
+	return location, nil
+}
+
+// Percentage of the brightness of every colour in ring order for the white balance presets, roughly the colour
+// temperature of a warm and a neutral white bulb
+var whiteBalances = map[string][COLOUR_COUNT]int{
+	"2700k": {100, 90, 70, 40, 15, 35},
+	"4000k": {100, 85, 75, 60, 45, 70},
+}
+
+// Percentage of the brightness of every colour in ring order, a preset (2700k or warm, 4000k or neutral) or six
+// percentages from red to white, every colour the same when empty
+func getWhiteBalance(str string) ([COLOUR_COUNT]int, error) {
+	balance := [COLOUR_COUNT]int{100, 100, 100, 100, 100, 100}
+	str = strings.ToLower(strings.TrimSpace(str))
+	switch str {
+		case "":
+			return balance, nil
+		case "warm":
+			str = "2700k"
+		case "neutral":
+			str = "4000k"
+	}
+	if preset, ok := whiteBalances[str]; ok {
+		return preset, nil
+	}
+
+	fields := strings.FieldsFunc(str, func(r rune) bool { return r == ' ' || r == ',' })
+	if len(fields) != COLOUR_COUNT {
+		return balance, fmt.Errorf("White balance `%s` given, has to be 2700k, 4000k or a percentage for each of the %d colours", str, COLOUR_COUNT)
+	}
+	for ring, field := range fields {
+		percentage, err := strconv.Atoi(field)
+		if err != nil || percentage < 0 || percentage > 100 {
+			return balance, fmt.Errorf("White balance for %s is `%s`, but has to be between 0 and 100", colours[ring], field)
+		}
+		balance[ring] = percentage
+	}
+	return balance, nil
+}
+
+// Scale every colour by its percentage of the white balance
+func (f *frame) balance(balance [COLOUR_COUNT]int) {
+	for led := range f {
+		f[led] = uint8(math.Round(float64(f[led]) * float64(balance[led % COLOUR_COUNT]) / 100))
+	}
+}
+
+// Add to (or take from) the brightness of a ring, staying between 0 and 255
+func (f *frame) boostRing(ring int, amount int) {
+	for arm := 0; arm < ARM_COUNT; arm++ {
+		led := arm * COLOUR_COUNT + ring
+		level := int(f[led]) + amount
+		if level > MAX_POWER {
+			level = MAX_POWER
+		} else if level < 0 {
+			level = 0
+		}
+		f[led] = uint8(level)
+	}
+}
+
+// Correct every LED for the response of its colour and limit it to the maximum of the colour
+func (f *frame) calibrate(table *calibration) {
+	for i := range f {
+		f[i] = table[i%COLOUR_COUNT][f[i]]
+	}
+}
+
+// Set all LEDs of a single colour, the other colours are left as they are
+func (f *frame) setColour(colour string, level uint8) error {
+	for ring, name := range colours {
+		if name != colour {
+			continue
+		}
+		for arm := 0; arm < ARM_COUNT; arm++ {
+			f[arm*COLOUR_COUNT+ring] = level
+		}
+		return nil
+	}
+	return fmt.Errorf("Colour `%s` given, but is not supported", colour)
+}
+
+func getTransitionSpeed(str string) (int, error) {
+	speed := strings.Replace(strings.ToLower(strings.TrimSpace(str)), " ", "", -1)
+	if len(speed) <= 0 {
+		return -1, errors.New("No transition time given")
+	}
+
+	timeType := speed[len(speed)-1:len(speed)]
+
+	if !unicode.IsLetter([]rune(timeType)[0]) {
+		timeType = "s"
+		speed += "s"
+	}
+
+	timeSpeed, e := strconv.Atoi(speed[:len(speed)-1])
+
+	if e != nil {
+		return -1, e
+	}
+
+	switch timeType {
+		case "s":
+		case "m":
+			timeSpeed *= 60
+		case "h":
+			timeSpeed *= 60 * 60
+		default:
+			return -1, fmt.Errorf("Time type `%s` given, but is not supported", timeType)
+	}
+
+	return timeSpeed, nil
+}
+
+// Parse an optional duration as Go duration (500ms, 1h30m) or in the same format as the transition speed, empty means zero
+func getDuration(str string) (time.Duration, error) {
+	if len(strings.TrimSpace(str)) <= 0 {
+		return 0, nil
+	}
+
+	if d, err := time.ParseDuration(strings.TrimSpace(str)); err == nil {
+		return d, nil
+	}
+
+	seconds, err := getTransitionSpeed(str)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
@@ -0,0 +1,558 @@
+package piglowambient
+
+import (
+	"errors"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLongTransitionAtHighLatitude(t *testing.T) {
+	// Oslo, the days and nights are never both shorter than 20 hours
+	cfg := testConfig()
+	cfg.Settings.Latitude = 59.91
+	cfg.Settings.Longitude = 10.75
+	cfg.Settings.TransitionSpeed = "20h"
+	err := validateConfig(&cfg)
+	if err == nil || !strings.Contains(err.Error(), "never stop fading") {
+		t.Fatalf("got %v, expected the lights to never stop fading", err)
+	}
+
+	// Longer than half a day, but the summer days are longer still
+	cfg.Settings.TransitionSpeed = "13h"
+	if err := validateConfig(&cfg); err != nil {
+		t.Fatalf("13 hours at a high latitude: %v", err)
+	}
+
+	// The minimum windows still have to fit in a day with both transitions
+	cfg.Settings.MinOffWindow = "1h"
+	if err := validateConfig(&cfg); err == nil || !strings.Contains(err.Error(), "do not fit in a day") {
+		t.Fatalf("got %v, expected the windows to not fit in a day", err)
+	}
+}
+
+func TestParseLateNightDim(t *testing.T) {
+	tests := []struct {
+		str string
+		points []curvePoint
+		err bool
+	}{
+		{"", nil, false},
+		{"  ", nil, false},
+		{"22:00 100, 01:00 50", []curvePoint{{second: 22 * 3600, power: 100}, {second: 25 * 3600, power: 50}}, false},
+		{"23:30 80,23:45 60, 00:15 40", []curvePoint{{second: 23 * 3600 + 1800, power: 80}, {second: 23 * 3600 + 2700, power: 60}, {second: 24 * 3600 + 900, power: 40}}, false},
+		{"22:00 100, 22:00 50", nil, true},
+		{"22:00 100, 21:00 50", []curvePoint{{second: 22 * 3600, power: 100}, {second: 45 * 3600, power: 50}}, false},
+		{"22:00 100, 23:00 80, 22:00 50", nil, true},
+		{"22:00", nil, true},
+		{"25:00 50", nil, true},
+		{"22:00 101", nil, true},
+		{"22:00 -1", nil, true},
+		{"22:00 half", nil, true},
+	}
+	for _, test := range tests {
+		points, err := parseLateNightDim(test.str)
+		if (err != nil) != test.err {
+			t.Errorf("`%s`: got error %v", test.str, err)
+			continue
+		}
+		if len(points) != len(test.points) {
+			t.Errorf("`%s`: got %v, expected %v", test.str, points, test.points)
+			continue
+		}
+		for i := range points {
+			if points[i] != test.points[i] {
+				t.Errorf("`%s`: got %v, expected %v", test.str, points, test.points)
+				break
+			}
+		}
+	}
+}
+
+func TestLateNightPercentage(t *testing.T) {
+	points, err := parseLateNightDim("22:00 100, 01:00 40")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		hour, minute int
+		percentage float64
+	}{
+		{12, 0, 100},
+		{22, 0, 100},
+		{23, 30, 70},
+		{0, 0, 60},
+		{1, 0, 40},
+		{11, 0, 40},
+		{12, 0, 100},
+		{21, 59, 100},
+	}
+	for _, test := range tests {
+		now := time.Date(2024, 1, 1, test.hour, test.minute, 0, 0, time.UTC)
+		if percentage := lateNightPercentage(points, now); percentage < test.percentage - 0.01 || percentage > test.percentage + 0.01 {
+			t.Errorf("%02d:%02d: got %.2f%%, expected %.2f%%", test.hour, test.minute, percentage, test.percentage)
+		}
+	}
+	if percentage := lateNightPercentage(nil, time.Now()); percentage != 100 {
+		t.Errorf("without points got %.2f%%, expected 100%%", percentage)
+	}
+}
+
+func TestScheduleSettingsChangedLateNightDim(t *testing.T) {
+	a, b := testConfig(), testConfig()
+	b.Settings.LateNightDim = "22:00 100, 01:00 50"
+	if !scheduleSettingsChanged(&a, &b) {
+		t.Fatal("a new late night dim does not count as a schedule change")
+	}
+}
+
+// Every device section gets a controller of its own, running its own schedule
+// The section of the machine's hostname goes over the top-level settings, it only overrides what it sets
+func TestHostSections(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "piglow.gcfg")
+	text := `[Settings]
+TransitionSpeed = 30m
+Latitude = 52.37
+Longitude = 4.90
+ActiveArm = 1
+
+[Host "pi-bedroom"]
+TransitionSpeed = 1h
+Latitude = 59.91
+Longitude = 10.75
+
+[Host "pi-kitchen"]
+TransitionSpeed = 2h
+`
+	if err := ioutil.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(lookup func() (string, error)) { lookupHostname = lookup }(lookupHostname)
+
+	tests := []struct {
+		hostname string
+		transitionSpeed string
+		latitude float64
+		logged string
+	}{
+		{"pi-bedroom", "1h", 59.91, "Using the settings of host pi-bedroom"},
+		{"pi-kitchen", "2h", 52.37, "Using the settings of host pi-kitchen"},
+		{"pi-hall", "30m", 52.37, "No host section for pi-hall"},
+	}
+	for _, test := range tests {
+		logged := captureLog(t)
+		lookupHostname = func() (string, error) { return test.hostname, nil }
+		conf, err := ReadConfigFile(path)
+		if err != nil {
+			t.Fatalf("%s: %v", test.hostname, err)
+		}
+		if conf.Settings.TransitionSpeed != test.transitionSpeed || conf.Settings.Latitude != test.latitude || conf.Settings.ActiveArm != "1" {
+			t.Errorf("%s: transition speed %s at latitude %f on arm %s", test.hostname, conf.Settings.TransitionSpeed, conf.Settings.Latitude, conf.Settings.ActiveArm)
+		}
+		if !strings.Contains(logged.String(), test.logged) {
+			t.Errorf("%s: logged %q", test.hostname, logged.String())
+		}
+	}
+
+	// Without a hostname the top-level settings are used
+	lookupHostname = func() (string, error) { return "", errors.New("no hostname") }
+	if conf, err := ReadConfigFile(path); err != nil || conf.Settings.TransitionSpeed != "30m" {
+		t.Fatalf("transition speed %s: %v", conf.Settings.TransitionSpeed, err)
+	}
+}
+
+func TestDeviceSections(t *testing.T) {
+	cfg := testConfig()
+	bedroom, kitchen := cfg.Settings, cfg.Settings
+	bedroom.TransitionSpeed = "2h"
+	kitchen.Latitude = 59.91
+	kitchen.Longitude = 10.75
+	cfg.Device = map[string]*Settings{"bedroom": &bedroom, "kitchen": &kitchen}
+	if err := validateConfig(&cfg); err != nil {
+		t.Fatalf("two device sections: %v", err)
+	}
+
+	bedroomGlow, kitchenGlow := &recordingGlow{}, &recordingGlow{}
+	bedroomCtl, kitchenCtl := NewDevice(cfg, "bedroom", bedroomGlow), NewDevice(cfg, "kitchen", kitchenGlow)
+	if bedroomCtl.transitionDuration != 2 * time.Hour || kitchenCtl.transitionDuration != 30 * time.Minute {
+		t.Fatalf("transitions of %v and %v", bedroomCtl.transitionDuration, kitchenCtl.transitionDuration)
+	}
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.Local)
+	if bedroomCtl.nextFadeIn(now).Equal(kitchenCtl.nextFadeIn(now)) {
+		t.Fatalf("both devices fade in at %s", bedroomCtl.nextFadeIn(now))
+	}
+
+	// And they write to their own PiGlow
+	bedroomCtl.writeFrame(bedroomCtl.renderFrame(now, 100))
+	if len(bedroomGlow.written()) == 0 || len(kitchenGlow.written()) > 0 {
+		t.Fatal("a frame of the bedroom was not written to the bedroom PiGlow only")
+	}
+
+	// Running next to each other they cannot share a control socket
+	bedroom.ControlSocket = "/run/piglow.sock"
+	kitchen.ControlSocket = "/run/piglow.sock"
+	if err := checkDevicesApart(&cfg); err == nil || !strings.Contains(err.Error(), "bedroom and kitchen") {
+		t.Fatalf("got %v, expected the shared control socket to be rejected", err)
+	}
+}
+
+func FuzzGetTransitionSpeed(f *testing.F) {
+	for _, seed := range []string{"30m", "1h", "90", " 2 h ", "", "h", "-5m", "1d", "99999999999h", "1.5h", "ü"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, str string) {
+		speed, err := getTransitionSpeed(str)
+		if err != nil && speed != -1 {
+			t.Fatalf("`%s`: got %d with error %v", str, speed, err)
+		}
+	})
+}
+
+func FuzzValidateConfig(f *testing.F) {
+	f.Add("30m", "", "", "", "", "", 52.37, 4.90)
+	f.Add("20h", "", "", "", "", "", 59.91, 10.75)
+	f.Add("1h", "2h", "3h", "22:00 100, 01:00 50", "23:00-07:00", "10-3", 69.65, 18.96)
+	f.Add("13h", "0", "1h", "01:00 50", "22:00-22:00", "2,", -90.0, 180.0)
+	f.Fuzz(func(t *testing.T, transition string, minOff string, minOn string, lateNight string, doNotDisturb string, months string, latitude float64, longitude float64) {
+		cfg := DefaultConfig()
+		cfg.Settings.TransitionSpeed = transition
+		cfg.Settings.MinOffWindow = minOff
+		cfg.Settings.MinOnWindow = minOn
+		cfg.Settings.LateNightDim = lateNight
+		cfg.Settings.DoNotDisturb = doNotDisturb
+		cfg.Settings.ActiveMonths = months
+		cfg.Settings.Latitude = latitude
+		cfg.Settings.Longitude = longitude
+		validateConfig(&cfg) // Any error is fine, as long as it does not panic
+	})
+}
+
+func TestActiveMonths(t *testing.T) {
+	tests := []struct {
+		str string
+		active []time.Month
+		count int
+		err bool
+	}{
+		{"", []time.Month{time.January, time.June, time.December}, 12, false},
+		{"10-03", []time.Month{time.October, time.November, time.December, time.January, time.March}, 6, false},
+		{" 10 - 3 ", []time.Month{time.October, time.March}, 6, false},
+		{"12-01", []time.Month{time.December, time.January}, 2, false},
+		{"04-09", []time.Month{time.April, time.June, time.September}, 6, false},
+		{"06-06", []time.Month{time.June}, 1, false},
+		{"01-12", []time.Month{time.January, time.June, time.December}, 12, false},
+		{"0-03", nil, 0, true},
+		{"10-13", nil, 0, true},
+		{"10", nil, 0, true},
+		{"10-03-05", nil, 0, true},
+		{"oct-mar", nil, 0, true},
+	}
+	for _, test := range tests {
+		from, to, err := getActiveMonths(test.str)
+		if (err != nil) != test.err {
+			t.Errorf("`%s`: got error %v", test.str, err)
+			continue
+		}
+		if test.err {
+			continue
+		}
+		active := 0
+		for month := time.January; month <= time.December; month++ {
+			if monthActive(month, from, to) {
+				active++
+			}
+		}
+		for _, month := range test.active {
+			if !monthActive(month, from, to) {
+				t.Errorf("`%s`: %s not active", test.str, month)
+			}
+		}
+		if active != test.count {
+			t.Errorf("`%s`: %d months active, expected %d", test.str, active, test.count)
+		}
+	}
+}
+
+// Around the edges of a season that wraps around the new year the night is dark out of season only
+func TestOutOfSeason(t *testing.T) {
+	cfg := testConfig()
+	cfg.Settings.ActiveMonths = "10-03"
+	c, _ := newTestController(t, cfg)
+	tests := []struct {
+		now time.Time
+		power int
+	}{
+		{time.Date(2025, 3, 31, 23, 30, 0, 0, time.UTC), MAX_POWER},
+		{time.Date(2025, 4, 1, 0, 30, 0, 0, time.UTC), 0},
+		{time.Date(2025, 9, 30, 23, 30, 0, 0, time.UTC), 0},
+		{time.Date(2025, 10, 1, 0, 30, 0, 0, time.UTC), MAX_POWER},
+		{time.Date(2025, 12, 31, 23, 30, 0, 0, time.UTC), MAX_POWER},
+		{time.Date(2026, 1, 1, 0, 30, 0, 0, time.UTC), MAX_POWER},
+	}
+	for _, test := range tests {
+		if power := c.ComputeScheduledPower(test.now); power != test.power {
+			t.Errorf("at %s: power %d, expected %d", test.now, power, test.power)
+		}
+	}
+}
+
+// Every colour has its own gamma, the ones not given fall back to the gamma of all colours
+func TestColourGamma(t *testing.T) {
+	colors := DefaultConfig().Colors
+	if gammas := colors.gammas(); gammas != [COLOUR_COUNT]float64{1, 1, 1, 1, 1, 1} {
+		t.Fatalf("default gammas %v", gammas)
+	}
+	for level := 0; level <= MAX_POWER; level++ {
+		if f := outputFrame(uniformFrame(level), false, colors.calibration()); f != uniformFrame(level) {
+			t.Fatalf("level %d written as %v by default", level, f)
+		}
+	}
+
+	colors.Gamma = 2.2
+	colors.RedGamma = 1
+	colors.BlueGamma = 3
+	expected := [COLOUR_COUNT]float64{1, 2.2, 2.2, 2.2, 3, 2.2}
+	if gammas := colors.gammas(); gammas != expected {
+		t.Fatalf("gammas %v, expected %v", gammas, expected)
+	}
+	f := outputFrame(uniformFrame(128), false, colors.calibration())
+	for led, level := range f {
+		ring := led % COLOUR_COUNT
+		if want := uint8(math.Round(MAX_POWER * math.Pow(128.0 / MAX_POWER, expected[ring]))); level != want {
+			t.Errorf("%s of arm %d at %d, expected %d with a gamma of %v", colours[ring], led / COLOUR_COUNT, level, want, expected[ring])
+		}
+	}
+	if f[0] != 128 || f[4] != 32 || f[5] != 56 {
+		t.Errorf("red, blue and white at %d, %d and %d", f[0], f[4], f[5])
+	}
+
+	// Zero or less is not a gamma, also not through the fallback
+	cfg := testConfig()
+	cfg.Colors.GreenGamma = -1
+	if err := validateConfig(&cfg); err == nil || !strings.Contains(err.Error(), "green") {
+		t.Errorf("got %v for a negative green gamma", err)
+	}
+	cfg = testConfig()
+	cfg.Colors.Gamma = 0
+	cfg.Colors.RedGamma = 2
+	if err := validateConfig(&cfg); err == nil || !strings.Contains(err.Error(), "orange") {
+		t.Errorf("got %v without a gamma for orange", err)
+	}
+}
+
+func TestParseBrightness(t *testing.T) {
+	tests := []struct {
+		str string
+		power int
+		err bool
+	}{
+		{"100%", MAX_POWER, false},
+		{"0%", 0, false},
+		{"128", 128, false},
+		{"50%", 128, false},
+		{" 12.5 % ", 32, false},
+		{"0", 0, false},
+		{"300", 300, false}, // In range or not is up to the setting
+		{"101%", 0, true},
+		{"-1%", 0, true},
+		{"%", 0, true},
+		{"12.5", 0, true},
+		{"bright", 0, true},
+		{"", 0, true},
+	}
+	for _, test := range tests {
+		power, err := parseBrightness(test.str)
+		if (err != nil) != test.err || power != test.power {
+			t.Errorf("`%s`: got %d with error %v, expected %d", test.str, power, err, test.power)
+		}
+	}
+
+	// Percentages in the settings and curve points, a raw value out of range is refused by the setting
+	cfg := testConfig()
+	var brightness Brightness
+	if err := brightness.UnmarshalText([]byte("25%")); err != nil || brightness != 64 {
+		t.Fatalf("got %d: %v", brightness, err)
+	}
+	cfg.Settings.PilotBrightness = brightness
+	cfg.Curve.Point = []string{"06:00 0%", "22:00 100%", "23:00 40"}
+	if err := validateConfig(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	if curve, err := parseCurve(cfg.Curve.Point); err != nil || curve[1].power != MAX_POWER || curve[2].power != 40 {
+		t.Fatalf("curve %v: %v", curve, err)
+	}
+	cfg.Settings.PilotBrightness = 300
+	if err := validateConfig(&cfg); err == nil {
+		t.Error("no error for a pilot brightness of 300")
+	}
+	if _, err := parseCurve([]string{"22:00 256"}); err == nil {
+		t.Error("no error for a curve point of 256")
+	}
+}
+
+func TestParseCoordinates(t *testing.T) {
+	tests := []struct {
+		str string
+		latitude, longitude float64
+		err bool
+	}{
+		{"52.37, 4.90", 52.37, 4.90, false},
+		{"52.37,4.90", 52.37, 4.90, false},
+		{"52.37 4.90", 52.37, 4.90, false},
+		{"52.37; 4.90", 52.37, 4.90, false},
+		{"52,37 4,90", 52.37, 4.90, false},
+		{"52.37N 4.90E", 52.37, 4.90, false},
+		{"N52.37 E4.90", 52.37, 4.90, false},
+		{"52.37° N, 4.90° E", 52.37, 4.90, false},
+		{"33.87S 151.21E", -33.87, 151.21, false},
+		{"33.87s 70.5w", -33.87, -70.5, false},
+		{"-33.87, -70.5", -33.87, -70.5, false},
+		{"-33.87S, 70.5", -33.87, 70.5, false},
+		{"  69, 19  ", 69, 19, false},
+		{"N52.37N 4.90", 0, 0, true},
+		{"52.37 E4.90W", 0, 0, true},
+		{"52.37E 4.90N", 0, 0, true},
+		{"91, 4.90", 0, 0, true},
+		{"52.37, 181", 0, 0, true},
+		{"52.37", 0, 0, true},
+		{"Amsterdam", 0, 0, true},
+		{"", 0, 0, true},
+	}
+	for _, test := range tests {
+		latitude, longitude, err := parseCoordinates(test.str)
+		if (err != nil) != test.err {
+			t.Errorf("`%s`: got error %v", test.str, err)
+			continue
+		}
+		if latitude != test.latitude || longitude != test.longitude {
+			t.Errorf("`%s`: got %v, %v, expected %v, %v", test.str, latitude, longitude, test.latitude, test.longitude)
+		}
+	}
+}
+
+// A fade out is the mirror image of a fade in of the same length, also halfway and past the end
+func TestFadesSymmetric(t *testing.T) {
+	for _, transitionTime := range []int{0, 1, 7, 60, 1800, 5399, 36000} {
+		duration := time.Duration(transitionTime) * time.Second
+		for _, elapsed := range []time.Duration{-time.Second, 0, time.Millisecond, duration / 3, duration / 2, duration - time.Millisecond, duration, 2 * duration} {
+			in, out := computeFadeInPower(elapsed, transitionTime), computeFadeOutPower(elapsed, transitionTime)
+			if in != MAX_POWER - out {
+				t.Errorf("%ds fade after %s: in at %d, out at %d", transitionTime, elapsed, in, out)
+			}
+			if inLevel, outLevel := fadeInLevel(elapsed, transitionTime), fadeOutLevel(elapsed, transitionTime); elapsed >= 0 && elapsed <= duration && math.Abs(inLevel - (MAX_POWER - outLevel)) > 1e-9 {
+				t.Errorf("%ds fade after %s: in at level %f, out at %f", transitionTime, elapsed, inLevel, outLevel)
+			}
+		}
+		if transitionTime > 0 && (computeFadeInPower(0, transitionTime) != 0 || computeFadeInPower(duration, transitionTime) != MAX_POWER) {
+			t.Errorf("%ds fade from %d to %d", transitionTime, computeFadeInPower(0, transitionTime), computeFadeInPower(duration, transitionTime))
+		}
+	}
+}
+
+// Coordinates copied with a decimal comma get a decimal point before gcfg reads them, with a warning, anything else is
+// left for gcfg to fail on
+func TestFixDecimalCommas(t *testing.T) {
+	tests := []struct {
+		text, fixed string
+		warned bool
+	}{
+		{"Latitude = 52,37", "Latitude = 52.37", true},
+		{"  longitude=-4,90  ", "  longitude=-4.90  ", true},
+		{"Longitude = \"151,21\"", "Longitude = \"151.21\"", true},
+		{"FallbackLatitude = 59,91", "FallbackLatitude = 59.91", true},
+		{"Latitude = 52.37", "Latitude = 52.37", false},
+		{"Latitude = 52,37,5", "Latitude = 52,37,5", false},
+		{"PilotBrightness = 8,5", "PilotBrightness = 8,5", false},
+		{"; Latitude = 52,37", "; Latitude = 52,37", false},
+		{"Coordinates = 52,37 4,90", "Coordinates = 52,37 4,90", false},
+	}
+	for _, test := range tests {
+		logged := captureLog(t)
+		if fixed := fixDecimalCommas("[Settings]\n" + test.text + "\nActiveArm = 1\n"); fixed != "[Settings]\n" + test.fixed + "\nActiveArm = 1\n" {
+			t.Errorf("`%s`: got %q", test.text, fixed)
+		}
+		if warned := strings.Contains(logged.String(), "use a decimal point"); warned != test.warned {
+			t.Errorf("`%s`: warned %v", test.text, warned)
+		}
+	}
+}
+
+func TestApplyCoordinates(t *testing.T) {
+	settings := DefaultConfig().Settings
+	settings.Coordinates = "59.91N 10.75E"
+	if err := settings.applyCoordinates(); err != nil {
+		t.Fatal(err)
+	}
+	if settings.Latitude != 59.91 || settings.Longitude != 10.75 || settings.Coordinates != "" {
+		t.Fatalf("got %v, %v and `%s` left", settings.Latitude, settings.Longitude, settings.Coordinates)
+	}
+
+	// Nothing given keeps the Latitude and Longitude
+	if err := settings.applyCoordinates(); err != nil || settings.Latitude != 59.91 {
+		t.Fatalf("got %v with error %v", settings.Latitude, err)
+	}
+}
+
+func TestGetDoNotDisturb(t *testing.T) {
+	tests := []struct {
+		str string
+		start, end int
+		ok, err bool
+	}{
+		{"", 0, 0, false, false},
+		{"   ", 0, 0, false, false},
+		{"23:30-06:00", 23 * 3600 + 1800, 6 * 3600, true, false},
+		{" 13:00 - 14:15 ", 13 * 3600, 14 * 3600 + 900, true, false},
+		{"00:00-07:00", 0, 7 * 3600, true, false},
+		{"22:00-22:00", 0, 0, false, true},
+		{"22:00", 0, 0, false, true},
+		{"22:00-07:00-08:00", 0, 0, false, true},
+		{"25:00-07:00", 0, 0, false, true},
+		{"22:00-7", 0, 0, false, true},
+	}
+	for _, test := range tests {
+		start, end, ok, err := getDoNotDisturb(test.str)
+		if (err != nil) != test.err || ok != test.ok || start != test.start || end != test.end {
+			t.Errorf("`%s`: got %d, %d, %v, %v", test.str, start, end, ok, err)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := newBackoff(HOOK_RETRY_INITIAL, HOOK_RETRY_MAX)
+	expected := []time.Duration{5 * time.Second, 10 * time.Second, 20 * time.Second, 40 * time.Second, 80 * time.Second, 2 * time.Minute, 2 * time.Minute}
+	for i, wait := range expected {
+		if next := b.next(); next != wait {
+			t.Fatalf("attempt %d: waiting %v, expected %v", i + 1, next, wait)
+		}
+	}
+	b.reset()
+	if next := b.next(); next != HOOK_RETRY_INITIAL {
+		t.Fatalf("waiting %v after a reset, expected %v", next, HOOK_RETRY_INITIAL)
+	}
+
+	tests := []struct {
+		initial, max time.Duration
+		first, limit time.Duration
+	}{
+		{0, 0, time.Minute, time.Hour},
+		{time.Second, 0, time.Second, time.Hour},
+		{2 * time.Hour, time.Minute, 2 * time.Hour, 2 * time.Hour},
+		{time.Second, time.Second, time.Second, time.Second},
+	}
+	for _, test := range tests {
+		b := newBackoff(test.initial, test.max)
+		if next := b.next(); next != test.first {
+			t.Errorf("%v up to %v: first wait %v, expected %v", test.initial, test.max, next, test.first)
+		}
+		for i := 0; i < 20; i++ {
+			b.next()
+		}
+		if next := b.next(); next != test.limit {
+			t.Errorf("%v up to %v: waits up to %v, expected %v", test.initial, test.max, next, test.limit)
+		}
+	}
+}
@@ -0,0 +1,477 @@
+package piglowambient
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const BIND_ATTEMPTS = 5
+const CONTROL_TIMEOUT = 10 * time.Second
+const TEST_PATTERN_POWER = 128
+const PREVIEW_FADE_SECONDS = 5
+const LIVE_SETTINGS_FILE = "zz-saved.gcfg"
+const SIMULATE_DURATION = 10 * time.Minute
+const LOG_TAIL_LINES = 50
+const ERROR_BLINK_COUNT = 3
+const ERROR_BLINK_TIME = 200 * time.Millisecond
+
+// Run a control command and return the reply
+func (c *Controller) Command(line string) string {
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return "no command given"
+	}
+
+	switch strings.ToLower(args[0]) {
+		case "testpattern":
+			if err := c.startOverride("testpattern", c.testPattern); err != nil {
+				return err.Error()
+			}
+			return "test pattern started"
+		case "previewfade":
+			if len(args) < 2 || (args[1] != "in" && args[1] != "out") {
+				return "usage: previewfade <in|out>"
+			}
+			fadeIn := args[1] == "in"
+			if err := c.startOverride("fade " + args[1] + " preview", func() { c.previewFade(fadeIn) }); err != nil {
+				return err.Error()
+			}
+			return "fade " + args[1] + " preview started"
+		case "profile":
+			if len(args) < 2 {
+				if c.profile == "" {
+					return "no profile active"
+				}
+				return "profile " + c.profile
+			}
+			if err := c.UseProfile(args[1]); err != nil {
+				return err.Error()
+			}
+			return "switched to profile " + args[1]
+		case "get":
+			if len(args) < 2 || strings.ToLower(args[1]) != "transitionspeed" {
+				return "usage: get transitionspeed"
+			}
+			return c.cfg.Settings.TransitionSpeed
+		case "set":
+			if len(args) < 3 || strings.ToLower(args[1]) != "transitionspeed" {
+				return "usage: set transitionspeed <speed>"
+			}
+			if err := c.setTransitionSpeed(strings.Join(args[2:], "")); err != nil {
+				return err.Error()
+			}
+			return "transition speed set to " + c.cfg.Settings.TransitionSpeed + ", use save to keep it after a restart"
+		case "save":
+			path, err := c.saveLiveSettings()
+			if err != nil {
+				return err.Error()
+			}
+			return "saved to " + path
+		case "reload":
+			if err := c.reloadOnRequest(); err != nil {
+				return err.Error()
+			}
+			return "configuration reloaded"
+		case "simulate":
+			if len(args) < 2 {
+				return "usage: simulate <pingdown|pingup|off> [now]"
+			}
+			reply, err := c.simulatePing(strings.ToLower(args[1]), len(args) > 2 && strings.ToLower(args[2]) == "now")
+			if err != nil {
+				return err.Error()
+			}
+			return reply
+		case "logs":
+			n := LOG_TAIL_LINES
+			if len(args) > 1 {
+				var err error
+				if n, err = strconv.Atoi(args[1]); err != nil || n <= 0 {
+					return "usage: logs [lines]"
+				}
+			}
+			lines, err := c.logTail(n)
+			if err != nil {
+				return err.Error()
+			}
+			return strings.Join(lines, "\n")
+		case "resync":
+			power, err := c.resync()
+			if err != nil {
+				return err.Error()
+			}
+			return fmt.Sprintf("schedule recalculated, brightness %d", power)
+		case "dnd":
+			if len(args) < 2 {
+				if c.doNotDisturb(time.Now()) {
+					return "do not disturb, lights off"
+				}
+				return "not in do not disturb"
+			}
+			switch strings.ToLower(args[1]) {
+				case "off":
+					return c.liftDoNotDisturb()
+				case "on":
+					c.dndLiftedUntil = time.Time{}
+					c.setGlow(c.power())
+					return "do not disturb is back"
+			}
+			return "usage: dnd [off|on]"
+		case "debug":
+			return c.DebugDump(len(args) > 1 && args[1] == "stacks")
+		case "status":
+			if len(args) > 1 && args[1] == "--json" {
+				return c.Status().JSON()
+			}
+			return c.Status().String()
+	}
+	return fmt.Sprintf("unknown command `%s`", args[0])
+}
+
+// Ping results replaced by the simulate command, for trying out what happens when the host goes down
+type pingSimulation struct {
+	active bool
+	up bool
+
+	// Zero when the state was switched right away, the next real result ends it then
+	until time.Time
+}
+
+// Start or stop simulating the ping host going down or coming up, right away skips the thresholds and grace period
+func (c *Controller) simulatePing(mode string, now bool) (string, error) {
+	if mode == "off" {
+		c.simulationLock.Lock()
+		c.simulation = pingSimulation{}
+		c.simulationLock.Unlock()
+		return "ping simulation stopped", nil
+	}
+	if mode != "pingdown" && mode != "pingup" {
+		return "", errors.New("usage: simulate <pingdown|pingup|off> [now]")
+	}
+	if c.forcePing == nil {
+		return "", errors.New("No ping check running")
+	}
+
+	up := mode == "pingup"
+	if now {
+		c.simulationLock.Lock()
+		c.simulation = pingSimulation{active: true, up: up}
+		c.simulationLock.Unlock()
+		log.Printf("Simulating %s", mode)
+		c.forcePing(up)
+		return "simulated " + mode + " until the next ping", nil
+	}
+
+	duration, err := getDuration(c.cfg.Settings.SimulateDuration)
+	if err != nil || duration <= 0 {
+		duration = SIMULATE_DURATION
+	}
+	c.simulationLock.Lock()
+	c.simulation = pingSimulation{active: true, up: up, until: time.Now().Add(duration)}
+	c.simulationLock.Unlock()
+	log.Printf("Simulating %s for %v", mode, duration)
+	return fmt.Sprintf("simulating %s for %v, the thresholds still apply", mode, duration), nil
+}
+
+// The result the ping check goes on, the simulated one while a simulation runs
+func (c *Controller) simulatedResult(isRecv bool) bool {
+	c.simulationLock.Lock()
+	defer c.simulationLock.Unlock()
+	if !c.simulation.active {
+		return isRecv
+	}
+	if c.simulation.until.IsZero() {
+		c.simulation = pingSimulation{}
+		return isRecv
+	}
+	if time.Now().After(c.simulation.until) {
+		log.Printf("Ping simulation expired")
+		c.simulation = pingSimulation{}
+		return isRecv
+	}
+	return c.simulation.up
+}
+
+// Whether the ping state comes from the simulate command
+func (c *Controller) pingSimulated() bool {
+	c.simulationLock.Lock()
+	defer c.simulationLock.Unlock()
+	return c.simulation.active
+}
+
+// The last n log lines
+func (c *Controller) logTail(n int) ([]string, error) {
+	if c.logBuffer == nil {
+		return nil, errors.New("No log lines kept")
+	}
+	return c.logBuffer.Tail(n), nil
+}
+
+// Read the configuration file again the same way as on SIGHUP
+func (c *Controller) reloadOnRequest() error {
+	if c.configFile == "" {
+		return errors.New("No configuration file to reload")
+	}
+	log.Printf("Reloading config on request...")
+	if err := c.ReloadFile(c.configFile); err != nil {
+		return fmt.Errorf("Reload failed, keeping the previous configuration: %s", err)
+	}
+	return nil
+}
+
+// Recalculate the schedule right now and go to the scheduled brightness, for after fixing the clock or the coordinates
+func (c *Controller) resync() (int, error) {
+	if c.started.IsZero() {
+		return 0, errors.New("Not running yet")
+	}
+
+	// Ask the geo source again, this clears a failed lookup or bad coordinates when they are fine now
+	newCfg := c.cfg
+	c.applyGeoSource(&newCfg)
+	c.configError = c.applyFallbackCoordinates(&newCfg)
+	c.cfg = newCfg
+
+	log.Printf("Resyncing on request...")
+	c.initSchedule()
+	c.logSchedule()
+	power := c.ComputeScheduledPower(time.Now())
+	if c.isPaused {
+		return power, errors.New("Schedule recalculated, not changing the brightness while paused")
+	}
+	if override := c.currentOverride(); override != "" {
+		return power, fmt.Errorf("Schedule recalculated, not changing the brightness while %s is running", override)
+	}
+	c.rampTo(c.runContext(), power)
+	return power, nil
+}
+
+// Light up during the do not disturb window anyway (only this once), it is back at the next window
+func (c *Controller) liftDoNotDisturb() string {
+	now := time.Now()
+	if !c.doNotDisturb(now) {
+		return "not in do not disturb"
+	}
+	c.dndLiftedUntil = now.Add(c.untilDoNotDisturbChange(now))
+	log.Printf("Do not disturb lifted on request until %s", c.logTime(c.dndLiftedUntil))
+	c.setGlow(c.power())
+	return "do not disturb lifted until " + c.logTime(c.dndLiftedUntil)
+}
+
+// Change the transition speed until the next restart or reload
+func (c *Controller) setTransitionSpeed(speed string) error {
+	// Checked like in the configuration file, a zero switches instantly. A mistyped command is not a broken
+	// configuration, so it is rejected before the reload.
+	newCfg := c.cfg
+	newCfg.Settings.TransitionSpeed = speed
+	if err := validateConfig(&newCfg); err != nil {
+		return err
+	}
+	if err := c.Reload(newCfg); err != nil {
+		return err
+	}
+	if c.cfg.Settings.TransitionSpeed != speed {
+		return errors.New("Could not apply the transition speed")
+	}
+	return nil
+}
+
+// Keep the settings changed with set in a drop-in file of the IncludeDir, so they are read again on a restart
+func (c *Controller) saveLiveSettings() (string, error) {
+	if c.cfg.Settings.IncludeDir == "" {
+		return "", errors.New("Saving needs an IncludeDir to write to")
+	}
+
+	section := "[Settings]"
+	if c.device != "" {
+		section = fmt.Sprintf("[Device \"%s\"]", c.device)
+	}
+	path := filepath.Join(c.cfg.Settings.IncludeDir, LIVE_SETTINGS_FILE)
+	text := fmt.Sprintf("; Written by the save command\n%s\nTransitionSpeed = %s\n", section, c.cfg.Settings.TransitionSpeed)
+	if err := ioutil.WriteFile(path, []byte(text), 0644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// Name of what took over the LEDs right now, empty when the schedule has them
+func (c *Controller) currentOverride() string {
+	c.overrideLock.Lock()
+	defer c.overrideLock.Unlock()
+	return c.override
+}
+
+// Take over the LEDs from the schedule until run returns, only one override can be active
+func (c *Controller) startOverride(name string, run func()) error {
+	c.overrideLock.Lock()
+	defer c.overrideLock.Unlock()
+	if c.override != "" {
+		return fmt.Errorf("%s is already running", c.override)
+	}
+	c.override = name
+
+	go func() {
+		defer func() {
+			c.overrideLock.Lock()
+			c.override = ""
+			c.overrideLock.Unlock()
+		}()
+		log.Printf("Started %s", name)
+		run()
+		log.Printf("Finished %s", name)
+	}()
+	return nil
+}
+
+// Light the LEDs one at a time to spot a dead one, then go back to the previous brightness
+func (c *Controller) testPattern() {
+	previous := c.power()
+	for led := 0; led < LED_COUNT; led++ {
+		log.Printf("Test pattern: LED %d (arm %d, %s)", led, led/COLOUR_COUNT, colours[led%COLOUR_COUNT])
+		var f frame
+		f[led] = TEST_PATTERN_POWER
+		c.writeFrame(f)
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	c.setGlow(0)
+	c.rampTo(c.runContext(), previous)
+}
+
+// Blink red a few times so someone at the PiGlow sees a reload was rejected, then go back to the previous brightness
+func (c *Controller) errorBlink() {
+	var f frame
+	f.setColour("red", TEST_PATTERN_POWER)
+	for i := 0; i < ERROR_BLINK_COUNT; i++ {
+		c.writeFrame(f)
+		time.Sleep(ERROR_BLINK_TIME)
+		c.writeFrame(frame{})
+		time.Sleep(ERROR_BLINK_TIME)
+	}
+	c.setGlow(c.power())
+}
+
+// Run a fade in or out like the schedule would, only compressed to a few seconds, then go back to the scheduled brightness
+func (c *Controller) previewFade(fadeIn bool) {
+	// Start from where the fade starts
+	if fadeIn {
+		c.rampTo(c.runContext(), 0)
+	} else {
+		c.rampTo(c.runContext(), MAX_POWER)
+	}
+
+	// The fade itself, compressed
+	if fadeIn {
+		c.FadeTo(c.runContext(), MAX_POWER, PREVIEW_FADE_SECONDS * time.Second)
+	} else {
+		c.FadeTo(c.runContext(), 0, PREVIEW_FADE_SECONDS * time.Second)
+	}
+
+	c.rampTo(c.runContext(), c.ComputeScheduledPower(time.Now()))
+}
+
+// Answer commands on the control socket until the context is done, not being able to listen is only fatal when required
+func (c *Controller) serveControl(ctx context.Context, path string, required bool) {
+	listener, err := listenControl(path)
+	if err != nil {
+		if required {
+			log.Fatalf("error listening on control socket: %v", err)
+		}
+		log.Printf("Warning: could not listen on control socket %s: %v", path, err)
+		return
+	}
+	log.Printf("Listening for commands on %s", path)
+
+	go func() {
+		<- ctx.Done()
+		listener.Close()
+		os.Remove(path)
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("error accepting control connection: %v", err)
+			continue
+		}
+		go func() {
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(CONTROL_TIMEOUT))
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil && line == "" {
+				return
+			}
+			fmt.Fprintln(conn, c.Command(line))
+		}()
+	}
+}
+
+// Listen on the control socket, after removing a stale one left behind
+func listenControl(path string) (net.Listener, error) {
+	removeStaleSocket(path)
+	return listenRetrying("unix", path)
+}
+
+// Listen on an address, when restarting quickly binding may fail for a moment (e.g. a port still in TIME_WAIT) so we
+// retry a few times
+func listenRetrying(network string, address string) (net.Listener, error) {
+	b := newBackoff(100 * time.Millisecond, 2 * time.Second)
+	for attempt := 1; ; attempt++ {
+		listener, err := net.Listen(network, address)
+		if err == nil {
+			return listener, nil
+		}
+		if attempt >= BIND_ATTEMPTS {
+			return nil, err
+		}
+		wait := b.next()
+		log.Printf("Could not listen on %s (attempt %d), retrying in %v: %v", address, attempt, wait, err)
+		time.Sleep(wait)
+	}
+}
+
+// A socket file nobody answers on is left over from a previous run
+func removeStaleSocket(path string) {
+	if _, err := os.Stat(path); err != nil {
+		return
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return
+	}
+	log.Printf("Removing stale control socket %s", path)
+	os.Remove(path)
+}
+
+// Send a command to a running daemon and return its reply
+func SendCommand(path string, command string) (string, error) {
+	conn, err := net.DialTimeout("unix", path, CONTROL_TIMEOUT)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(CONTROL_TIMEOUT))
+
+	if _, err := fmt.Fprintln(conn, command); err != nil {
+		return "", err
+	}
+
+	var reply strings.Builder
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		reply.WriteString(scanner.Text())
+		reply.WriteString("\n")
+	}
+	return strings.TrimRight(reply.String(), "\n"), scanner.Err()
+}
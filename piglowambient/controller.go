@@ -0,0 +1,1564 @@
+package piglowambient
+
+import (
+	"github.com/tatsushid/go-fastping"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The LEDs we drive, *piglow.Piglow satisfies this
+type Glow interface {
+	SetLED(led int8, level uint8)
+	Apply() error
+}
+
+// A Glow that can let go of the I2C bus while the lights are off and take it again
+type SleepingGlow interface {
+	Glow
+	Sleep() error
+	Wake() error
+}
+
+// Stand-in for a PiGlow that is not there, nothing gets written anywhere
+type DryRunGlow struct{}
+
+func (DryRunGlow) SetLED(led int8, level uint8) {}
+func (DryRunGlow) Apply() error { return nil }
+
+// Check that a PiGlow actually responds by switching all LEDs off, opening the bus alone succeeds without one
+func Probe(glow Glow) error {
+	for led := 0; led < LED_COUNT; led++ {
+		glow.SetLED(int8(led), 0)
+	}
+	return glow.Apply()
+}
+
+// Wait the StartupDelay to let the system settle after boot, returns false when the context is done first
+func WaitStartupDelay(ctx context.Context, cfg Config) bool {
+	delay, _ := getDuration(cfg.Settings.StartupDelay) // Already validated
+	if delay <= 0 {
+		return true
+	}
+
+	end := time.Now().Add(delay)
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		remaining := time.Until(end)
+		if remaining <= 0 {
+			return true
+		}
+		log.Printf("Starting in %v", remaining.Round(time.Second))
+
+		select {
+			case <- ctx.Done():
+				return false
+			case <- ticker.C:
+			case <- time.After(remaining):
+		}
+	}
+}
+
+// The sun today, for checking the coordinates
+type solarDay struct {
+	date time.Time
+	sunrise time.Time
+	sunset time.Time
+	noon time.Time
+	length time.Duration
+}
+
+// One round of pings to the added addresses, *fastping.Pinger satisfies this
+type Pinger interface {
+	AddIPAddr(ip *net.IPAddr)
+	AddHandler(event string, handler interface{}) error
+	Source(source string) (string, error)
+	Run() error
+}
+
+// Looks up every address of a host
+type Resolver func(host string) ([]*net.IPAddr, error)
+
+// Settings used for every frame, parsed once instead of on every write
+type renderSettings struct {
+	layout [LED_COUNT]int
+	balance [COLOUR_COUNT]int
+	arm int // -1 for all arms
+	pilot []int
+	twilightBalance map[string][COLOUR_COUNT]int // Of the twilights with a balance of their own
+	calibration *calibration
+
+	// Do not disturb window in seconds since midnight, when there is one
+	dnd bool
+	dndStart int
+	dndEnd int
+}
+
+// Runs the ambient schedule on a PiGlow
+type Controller struct {
+	cfg Config
+	fullCfg Config
+	profile string
+	glow Glow
+
+	// File the reload command reads, see SetConfigFile
+	configFile string
+
+	// Recent log lines for the logs command, see SetLogBuffer
+	logBuffer *LogBuffer
+	device string
+
+	// Cleared when Run returns, the goroutines in the background stop then
+	runLock sync.Mutex
+	isRunning bool
+	isPaused bool
+
+	// Why the schedule is paused, the ping check goes before the presence
+	pauseLock sync.Mutex
+	pausedByPing bool
+	away bool
+
+	presenceGeneration int
+	configError bool
+
+	// Brightness asked for last and when the lights last came on (for the MinOnTime), set by every FadeTo step
+	powerLock sync.Mutex
+	currentPower int
+	onSince time.Time
+
+	// Do not disturb is lifted by the dnd command until this time, dndActive is what was last shown
+	dndLiftedUntil time.Time
+	dndActive bool
+
+	// Brightness on its way to the requested one at the MaxSlewRate
+	slewLock sync.Mutex
+	slewLevel float64
+	slewTime time.Time
+	slewPending bool
+	slewTarget int // The latest brightness asked for, where the steps written by the slew itself are going
+
+	// Schedule
+	transitionTime int
+	transitionDuration time.Duration
+	sleepDuration time.Duration
+	fadeInTime time.Time
+	fadeOutTime time.Time
+	scheduleChanged bool
+	displayZone *time.Location // Of the DisplayTimezone, nil for the local one
+
+	// Control points of the [Curve], empty to follow the sun
+	curve []curvePoint
+
+	// Last twilight point passed, for announcing the next one
+	twilightPhase string
+
+	// Percentage left of the brightness over the night, empty when not dimming
+	lateNightDim []curvePoint
+
+	// Solar noon the noon accent is currently centered on
+	accentNoon time.Time
+	solar solarDay
+	solarCache solarCache
+
+	// Settings of the render path, parsed by initRender
+	render renderSettings
+
+	// Last frame written to the PiGlow
+	lastFrame frame
+	lastFrameValid bool
+	lastWrite time.Time
+	skippedWrites int
+
+	// Writes that failed in a row, the frame is tried again after a backoff so one device failing does not stop the
+	// others (guarded by writeLock)
+	glowFailures int
+	glowRetry *backoff
+	glowRetryAt time.Time
+
+	// Nothing is written while the lights are off after a fade out, see SleepWhenOff
+	deviceAsleep bool
+
+	// Writes per second the PiGlow managed at startup, zero when not measured
+	measuredWriteRate float64
+	rateCapLogged bool
+
+	// Frame held back by the write cooldown
+	writeLock sync.Mutex
+	pendingFrame frame
+	pendingFrameValid bool
+
+	started time.Time
+
+	// The control socket and the HTTP server run until the context of Run is done, or until their own cancel when
+	// the address changes on a reload
+	runCtx context.Context
+	stopControl context.CancelFunc
+	stopHttp context.CancelFunc
+
+	resolve Resolver
+	newPinger func() Pinger
+	pingGeneration int
+	pingState int
+
+	// Results of the running ping check are handled one at a time, also the ones of the simulate command
+	pingLock sync.Mutex
+	forcePing func(up bool)
+	simulationLock sync.Mutex
+	simulation pingSimulation
+	geoCache geoCache
+	geoFound chan geoResult
+
+	// When the last fades completed compared to the schedule
+	fadeHistory []FadeRecord
+
+	// Outside of the ActiveMonths
+	outOfSeason bool
+
+	// What runs on a fallback or failed, for the status
+	health health
+
+	// Increased by every FadeTo so a running one knows it was taken over
+	fadeLock sync.Mutex
+	fadeGeneration int
+
+	// The state file could not be written, do not keep trying
+	stateUnwritable bool
+
+	// Whether the sunrise hook already ran this morning
+	sunriseHookFired bool
+
+	// Name of what took over the LEDs from the schedule (e.g. the test pattern), empty when nothing
+	overrideLock sync.Mutex
+	override string
+
+	// Dithering the bottom of a fade, with the part of a step still to show
+	dithering bool
+	ditherError float64
+
+	// PNG of the last frame for /preview.png
+	previewImage previewImage
+}
+
+// Create a controller for the configuration, coordinates from a geo source are resolved right away
+func New(cfg Config, glow Glow) *Controller {
+	return NewDevice(cfg, "", glow)
+}
+
+// Create a controller for one of the [Device "name"] sections, every device runs its own schedule
+func NewDevice(cfg Config, device string, glow Glow) *Controller {
+	c := &Controller{cfg: cfg.ForDevice(device), fullCfg: cfg, glow: glow, device: device, isRunning: true, glowRetry: newBackoff(time.Second, time.Minute), geoFound: make(chan geoResult, 1)}
+	c.SetNetwork(resolvePingAddrs, func() Pinger { return fastping.NewPinger() })
+
+	// Continue with the profile that was active before the restart
+	if c.profile = c.loadProfile(); c.profile != "" {
+		log.Printf("Using profile %s", c.profile)
+		c.cfg = c.configFor(cfg, c.profile)
+	}
+	c.applyGeoSource(&c.cfg)
+	c.configError = c.applyFallbackCoordinates(&c.cfg) // Keep blinking until the configuration is fixed
+	c.initSchedule()
+	c.initRender()
+	return c
+}
+
+// Replace how the ping check resolves and pings the host (e.g. by fakes without network access), before Run
+func (c *Controller) SetNetwork(resolve Resolver, newPinger func() Pinger) {
+	c.resolve = resolve
+	c.newPinger = newPinger
+}
+
+// Run the schedule until the context is done (or the maximum runtime is reached)
+func (c *Controller) Run(ctx context.Context) {
+	c.started = time.Now()
+	c.measureWriteRate()
+
+	// Start at the scheduled brightness, when we have a persisted brightness move there from what was shown before the restart
+	scheduledPower := c.ComputeScheduledPower(time.Now())
+	initialPower := scheduledPower
+	if c.cfg.Settings.StateFile != "" {
+		initialPower = c.loadState()
+	}
+	c.softStart(ctx, initialPower)
+	c.rampTo(ctx, scheduledPower)
+
+	// Announce some basic information
+	c.logSchedule()
+
+	// Initialize pings checks just before main loop (to let the program boot)
+	c.initPing(c.cfg.Settings.PingRequired)
+	c.initPresence()
+
+	// Accept commands
+	c.runCtx = ctx
+	c.startControl(true)
+	c.startHttp(true)
+
+	// Stop by ourselves after the maximum runtime, if any
+	maxRuntime, err := getDuration(c.cfg.Settings.MaxRuntime)
+	if err != nil {
+		log.Fatalf("error parsing maximum runtime: %v", err)
+	}
+	parent := ctx
+	if maxRuntime > 0 {
+		log.Printf("Exiting after running for %v", maxRuntime)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, maxRuntime)
+		defer cancel()
+	}
+
+	// Main loop
+	savedPower := c.power()
+	savedTime := time.Now()
+	indicatedTime := time.Now()
+	for ctx.Err() == nil {
+		// Coordinates a geo source retry found in the background
+		select {
+			case found := <- c.geoFound:
+				c.useGeoResult(found)
+			default:
+		}
+
+		// Pick up a changed schedule after a reload
+		if c.scheduleChanged {
+			c.scheduleChanged = false
+			c.initSchedule()
+			c.logSchedule()
+		}
+
+		// Going into or out of the do not disturb window
+		if dnd := c.doNotDisturb(time.Now()); dnd != c.dndActive {
+			c.dndActive = dnd
+			if dnd {
+				log.Printf("Do not disturb, lights off for %v", c.untilDoNotDisturbChange(time.Now()).Round(time.Minute))
+			} else {
+				log.Printf("Do not disturb is over")
+			}
+			c.setGlow(c.power())
+		}
+
+		// Show abnormal states every now and then
+		if (c.isPaused || c.configError) && time.Since(indicatedTime) > 10 * time.Second {
+			if c.pausedByPing && c.power() == 0 && !c.cfg.Settings.PauseOnUp {
+				c.indicate(StatusPingDown)
+			}
+			if c.configError {
+				c.indicate(StatusConfigError)
+			}
+			indicatedTime = time.Now()
+		}
+
+		// Persist the brightness every now and then
+		if c.power() != savedPower && time.Since(savedTime) > 30 * time.Second {
+			c.saveState(c.power())
+			savedPower = c.power()
+			savedTime = time.Now()
+		}
+
+		// Sleep
+		sleptAt := time.Now()
+		time.Sleep(c.loopWait(sleptAt))
+
+		if gap := suspendedFor(sleptAt, time.Now().Round(0), time.Since(sleptAt)); gap > SUSPEND_THRESHOLD {
+			c.resumeFromSuspend(ctx, gap)
+		}
+
+		// Check if we are sleeping or something else is using the LEDs
+		if c.isPaused || c.currentOverride() != "" {
+			continue
+		}
+
+		// Out of season the lights stay off, the fades start again once it begins
+		if !c.inSeason(time.Now()) {
+			if !c.outOfSeason {
+				log.Printf("Outside of the active months, lights off")
+				c.outOfSeason = true
+			}
+			c.setGlow(0)
+			continue
+		}
+		if c.outOfSeason {
+			log.Printf("The active months started")
+			c.outOfSeason = false
+			c.initSchedule()
+			c.logSchedule()
+			c.rampTo(ctx, c.ComputeScheduledPower(time.Now()))
+		}
+
+		// A curve replaces the sun
+		if len(c.curve) > 0 {
+			c.setGlow(curvePower(c.curve, time.Now()))
+			continue
+		}
+
+		// The twilights replace the fades
+		if len(c.cfg.Twilight) > 0 {
+			c.setGlow(c.twilightPower(time.Now()))
+			continue
+		}
+
+		// Have the PiGlow ready when the fade in starts
+		if c.deviceAsleep && c.untilNextFade(time.Now()) <= c.sleepDuration {
+			c.wakeDeviceEarly()
+		}
+
+		c.runFades(time.Now())
+
+		// Render again so time based overlays keep moving outside of the fades
+		c.setGlow(c.power())
+	}
+	c.setRunning(false)
+
+	// Remember where we were for the next start
+	c.saveState(c.power())
+
+	// Nobody asked us to stop so do not leave the lights on
+	if parent.Err() == nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		log.Printf("Maximum runtime reached, goodbye!")
+		c.rampTo(parent, 0)
+	}
+}
+
+// Read the configuration file again and apply it, a broken file keeps the previous configuration running
+func (c *Controller) ReloadFile(path string) error {
+	newCfg, err := ReadConfigFile(path)
+	if err != nil {
+		c.reloadFailed(err)
+		return err
+	}
+	c.fullCfg = newCfg
+	if _, ok := newCfg.Profile[c.profile]; c.profile != "" && !ok {
+		log.Printf("Profile %s is gone, using the base settings", c.profile)
+		c.profile = ""
+		c.saveProfile()
+	}
+	return c.Reload(c.configFor(newCfg, c.profile))
+}
+
+// Where the logs command gets the recent log lines from, the log output has to be teed into it
+func (c *Controller) SetLogBuffer(buffer *LogBuffer) {
+	c.logBuffer = buffer
+	buffer.SetSize(c.cfg.Settings.LogBufferLines)
+}
+
+// Configuration file the reload command reads again, the same one as SIGHUP
+func (c *Controller) SetConfigFile(path string) {
+	c.configFile = path
+}
+
+// Switch to one of the [Profile "name"] sections, or back to the base settings with none
+func (c *Controller) UseProfile(name string) error {
+	if strings.ToLower(name) == PROFILE_NONE {
+		name = ""
+	} else if _, ok := c.fullCfg.Profile[name]; !ok {
+		return fmt.Errorf("Unknown profile `%s`", name)
+	}
+
+	c.profile = name
+	c.saveProfile()
+	newCfg := c.configFor(c.fullCfg, name)
+
+	// Not running yet, nothing to restart
+	if c.started.IsZero() {
+		c.cfg = newCfg
+		c.applyGeoSource(&c.cfg)
+		c.configError = c.applyFallbackCoordinates(&c.cfg)
+		c.initSchedule()
+		c.initRender()
+		return nil
+	}
+	return c.Reload(newCfg)
+}
+
+// Configuration of our device with a profile applied
+func (c *Controller) configFor(cfg Config, profile string) Config {
+	profiled := cfg.ForProfile(profile)
+	return profiled.ForDevice(c.device)
+}
+
+// The profile is kept next to the state file (when there is one)
+func (c *Controller) profileFile() string {
+	if c.cfg.Settings.StateFile == "" {
+		return ""
+	}
+	return c.cfg.Settings.StateFile + ".profile"
+}
+
+func (c *Controller) loadProfile() string {
+	path := c.profileFile()
+	if path == "" {
+		return ""
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	name := strings.TrimSpace(string(data))
+	if _, ok := c.fullCfg.Profile[name]; !ok {
+		return ""
+	}
+	return name
+}
+
+func (c *Controller) saveProfile() {
+	path := c.profileFile()
+	if path == "" || c.stateUnwritable {
+		return
+	}
+	if err := ioutil.WriteFile(path, []byte(c.profile), 0644); err != nil {
+		log.Printf("Warning: could not write profile file: %v", err)
+	}
+}
+
+// Show the scheduled brightness for right now a single time, a failing write exits
+func (c *Controller) ShowOnce() {
+	power := c.ComputeScheduledPower(time.Now())
+	c.powerLock.Lock()
+	c.currentPower = power
+	c.powerLock.Unlock()
+	c.writeFrame(c.renderFrame(time.Now(), power)) // Without the slew, we exit right after
+	if c.failingWrites() > 0 {
+		log.Fatal("Could not set PiGlow")
+	}
+	log.Printf("Brightness set to %d", power)
+}
+
+// Switch to a new configuration and only restart what changed, an invalid configuration keeps the previous one running
+func (c *Controller) Reload(newCfg Config) error {
+	c.applyGeoSource(&newCfg)
+	if err := validateConfig(&newCfg); err != nil {
+		c.reloadFailed(err)
+		return err
+	}
+	fallback := c.applyFallbackCoordinates(&newCfg)
+	c.recover("config")
+
+	oldCfg := c.cfg
+	c.cfg = newCfg
+	c.initRender()
+	c.configError = fallback
+	if c.logBuffer != nil {
+		c.logBuffer.SetSize(newCfg.Settings.LogBufferLines)
+	}
+
+	reloaded := false
+	if pingSettingsChanged(&oldCfg, &newCfg) {
+		log.Printf("Ping settings changed, restarting ping check")
+		c.restartPing()
+		reloaded = true
+	}
+	if presenceSettingsChanged(&oldCfg, &newCfg) {
+		log.Printf("Presence settings changed, restarting the presence checks")
+		c.restartPresence()
+		reloaded = true
+	}
+	if oldCfg.Settings.ControlSocket != newCfg.Settings.ControlSocket {
+		log.Printf("Control socket changed, listening again")
+		c.startControl(false) // Never stop a running daemon on a reload
+		reloaded = true
+	}
+	if oldCfg.Settings.HttpAddress != newCfg.Settings.HttpAddress {
+		log.Printf("HTTP address changed, listening again")
+		c.startHttp(false)
+		reloaded = true
+	}
+	if scheduleSettingsChanged(&oldCfg, &newCfg) {
+		log.Printf("Coordinates or transition changed, recalculating fades")
+		c.scheduleChanged = true
+		reloaded = true
+	}
+	if !reloaded {
+		log.Printf("Nothing that needs a restart changed")
+	}
+	c.sendEvent("reload", "succeeded")
+	return nil
+}
+
+func (c *Controller) reloadFailed(err error) {
+	log.Printf("Invalid configuration, keeping the previous configuration: %s", err)
+	c.configError = true
+	c.degrade("config", err.Error())
+	c.sendEvent("reload", fmt.Sprintf("failed: %s", err))
+
+	// Nothing to blink before we run, a broken configuration then does not start at all
+	if c.cfg.Settings.ReloadErrorBlink && !c.started.IsZero() {
+		if err := c.startOverride("reload error blink", c.errorBlink); err != nil {
+			log.Printf("Not blinking the rejected reload: %v", err)
+		}
+	}
+}
+
+// Listen on the control socket of the current configuration, when required failing to listen is fatal
+func (c *Controller) startControl(required bool) {
+	if c.stopControl != nil {
+		c.stopControl()
+		c.stopControl = nil
+	}
+	if c.cfg.Settings.ControlSocket == "" || c.runCtx == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(c.runCtx)
+	c.stopControl = cancel
+	go c.serveControl(ctx, c.cfg.Settings.ControlSocket, required)
+}
+
+// Serve HTTP on the address of the current configuration, when required failing to listen is fatal
+func (c *Controller) startHttp(required bool) {
+	if c.stopHttp != nil {
+		c.stopHttp()
+		c.stopHttp = nil
+	}
+	if c.cfg.Settings.HttpAddress == "" || c.runCtx == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(c.runCtx)
+	c.stopHttp = cancel
+	go c.serveHttp(ctx, c.cfg.Settings.HttpAddress, required)
+}
+
+// Whether Run has not returned yet
+func (c *Controller) running() bool {
+	c.runLock.Lock()
+	defer c.runLock.Unlock()
+	return c.isRunning
+}
+
+func (c *Controller) setRunning(running bool) {
+	c.runLock.Lock()
+	defer c.runLock.Unlock()
+	c.isRunning = running
+}
+
+// Whether the ping check of the generation is still the one that runs
+func (c *Controller) isPing(generation int) bool {
+	c.pingLock.Lock()
+	defer c.pingLock.Unlock()
+	return c.running() && generation == c.pingGeneration
+}
+
+// Stop the running ping check and start one with the current configuration
+func (c *Controller) restartPing() {
+	c.pingLock.Lock()
+	c.pingGeneration++
+	c.pingLock.Unlock()
+
+	// Do not stay paused on a ping check that is gone
+	if c.pausedByPing {
+		c.resume()
+	}
+	c.initPing(false) // Never stop a running daemon on a reload
+}
+
+// Start the ping check, when required a missing or unresolvable target is fatal
+func (c *Controller) initPing(required bool) {
+	// Default state
+	c.pingLock.Lock()
+	generation := c.pingGeneration
+	c.pingLock.Unlock()
+	// The results, the replies and the pending pause are all behind pingLock
+	var tracker pingTracker
+	var isRecv bool
+	var lastRtt time.Duration
+	var pausePending bool
+	var pendingState int
+	var graceTimer *time.Timer
+	c.pingState = PingUnknown
+
+	// Grace period to keep listening for a late reply before pausing
+	grace, err := getDuration(c.cfg.Settings.PingGracePeriod)
+	if err != nil {
+		log.Fatalf("error parsing ping grace period: %v", err)
+	}
+
+	// Disabling this feature if no IP given
+	if c.cfg.Settings.PingIp == "" {
+		if required {
+			log.Fatalf("No ping IP given but the ping check is required")
+		}
+		log.Printf("No ping IP given, ping check disabled")
+		c.pingState = PingDisabled
+		c.forcePing = nil
+		c.recover("ping")
+		return
+	}
+
+	// Pause on a ping state, lights that only just came on get their minimum on time first
+	pauseFor := func(state int, event string, detail string) {
+		if wait := c.untilMinOnTime(); wait > 0 {
+			log.Printf("The lights are on for less than the minimum on time, pausing in %v unless %s changes", wait.Round(time.Second), c.cfg.Settings.PingIp)
+			time.AfterFunc(wait, func() {
+				c.pingLock.Lock()
+				defer c.pingLock.Unlock()
+				if generation == c.pingGeneration && tracker.state == state && !c.pausedByPing {
+					c.sendEvent(event, detail)
+					c.pause()
+				}
+			})
+			return
+		}
+		c.sendEvent(event, detail)
+		c.pause()
+	}
+
+	// React to the tracker switching state, the grace period only applies to real results
+	changed := func(lastState int, withGrace bool) {
+		c.pingState = tracker.state
+
+		// Inverted, the lights are off while the host is there
+		if c.cfg.Settings.PauseOnUp {
+			if tracker.state == PingUp {
+				log.Printf("Remote %s came up, RTT: %v, pausing", c.cfg.Settings.PingIp, lastRtt)
+				pauseFor(PingUp, "up", fmt.Sprintf("%s came up, RTT: %v", c.cfg.Settings.PingIp, lastRtt))
+			} else if tracker.state == PingDown && c.pausedByPing {
+				log.Printf("Remote %s went down, resuming", c.cfg.Settings.PingIp)
+				c.sendEvent("down", fmt.Sprintf("%s went down", c.cfg.Settings.PingIp))
+				c.resume()
+			}
+			return
+		}
+
+		if tracker.state == PingUp && lastState == PingDown {
+			log.Printf("Remote %s came up, RTT: %v", c.cfg.Settings.PingIp, lastRtt)
+			c.sendEvent("up", fmt.Sprintf("%s came up, RTT: %v", c.cfg.Settings.PingIp, lastRtt))
+			c.resume()
+		} else if tracker.state == PingDown {
+			log.Printf("Remote %s went down", c.cfg.Settings.PingIp)
+			if withGrace && grace > 0 {
+				// Only pause when no reply at all came in during the grace period
+				pausePending = true
+				pendingState = lastState
+				graceTimer = time.AfterFunc(grace, func() {
+					c.pingLock.Lock()
+					defer c.pingLock.Unlock()
+					if generation == c.pingGeneration && pausePending {
+						pausePending = false
+						pauseFor(PingDown, "down", fmt.Sprintf("%s went down", c.cfg.Settings.PingIp))
+					}
+				})
+				return
+			}
+			pauseFor(PingDown, "down", fmt.Sprintf("%s went down", c.cfg.Settings.PingIp))
+		}
+	}
+
+	// A reply, also a late one after the end of a run. Within the grace period it keeps the lights on.
+	reply := func(rtt time.Duration) {
+		c.pingLock.Lock()
+		defer c.pingLock.Unlock()
+		isRecv = true
+		lastRtt = rtt
+		if pausePending && generation == c.pingGeneration && c.simulatedResult(true) {
+			log.Printf("Remote %s answered within the grace period, not pausing", c.cfg.Settings.PingIp)
+			pausePending = false
+			graceTimer.Stop()
+			tracker = pingTracker{state: pendingState}
+			c.pingState = tracker.state
+		}
+	}
+
+	// Feed the result of a check (isRecv flag) to the tracker, called always at the end of a run
+	handleResult := func() {
+		c.pingLock.Lock()
+		defer c.pingLock.Unlock()
+		if generation != c.pingGeneration {
+			return
+		}
+		received := c.simulatedResult(isRecv)
+		isRecv = false // Used up, a pinger that keeps running (like the fastping RunLoop) starts over without a reply
+
+		// A pause is waiting out the grace period, a reply in there already called it off
+		if pausePending {
+			return
+		}
+
+		lastState := tracker.state
+		if !tracker.record(received, c.cfg.Settings.PingUpThreshold, c.cfg.Settings.PingDownThreshold) {
+			return
+		}
+		changed(lastState, true)
+	}
+
+	// Switch the state right away for the simulate command, the next real result takes over from there
+	c.forcePing = func(up bool) {
+		c.pingLock.Lock()
+		defer c.pingLock.Unlock()
+		if generation != c.pingGeneration {
+			return
+		}
+
+		lastState := tracker.state
+		tracker = pingTracker{state: PingDown}
+		if up {
+			tracker.state = PingUp
+		}
+		if pausePending {
+			pausePending = false
+			graceTimer.Stop()
+		}
+		if tracker.state != lastState {
+			changed(lastState, false)
+		}
+	}
+
+	// Check every minute for host, throughout the grace period every second so a reply can still come in
+	wait := func() {
+		c.pingLock.Lock()
+		pending := pausePending
+		c.pingLock.Unlock()
+		if pending {
+			time.Sleep(PING_GRACE_INTERVAL)
+		} else {
+			time.Sleep(time.Minute)
+		}
+	}
+
+	// Connecting over TCP does not need the raw socket privileges ICMP does
+	if strings.ToLower(c.cfg.Settings.CheckMode) == "tcp" {
+		address := net.JoinHostPort(c.cfg.Settings.PingIp, strconv.Itoa(c.cfg.Settings.CheckPort))
+		log.Printf("Checking %s over TCP", address)
+		go func(){
+			for c.isPing(generation) {
+				started := time.Now()
+				conn, err := net.DialTimeout("tcp", address, TCP_CHECK_TIMEOUT)
+				if err == nil {
+					reply(time.Since(started))
+					conn.Close()
+				}
+				handleResult()
+				wait()
+			}
+		}()
+		return
+	}
+
+	// Resolve host, a target we cannot resolve disables the feature unless it is required
+	p := c.newPinger()
+	addrs, err := c.resolve(c.cfg.Settings.PingIp)
+	if err != nil {
+		if required {
+			log.Fatalf("error resolving IP address: %v", err)
+		}
+		log.Printf("Warning: could not resolve ping IP %s, disabling ping check: %v", c.cfg.Settings.PingIp, err)
+		c.pingState = PingDisabled
+		c.forcePing = nil
+		c.degrade("ping", fmt.Sprintf("could not resolve %s, ping check disabled: %v", c.cfg.Settings.PingIp, err))
+		return
+	}
+	c.recover("ping")
+
+	// Send the pings from a specific address when asked for
+	if c.cfg.Settings.PingSource != "" {
+		source, err := getPingSource(c.cfg.Settings.PingSource)
+		if err != nil {
+			log.Fatalf("error finding ping source: %v", err)
+		}
+		if _, err := p.Source(source); err != nil {
+			log.Fatalf("error setting ping source: %v", err)
+		}
+		log.Printf("Pinging %s from %s", c.cfg.Settings.PingIp, source)
+	}
+
+	// Add the IPs and add the receive handler, the host is up when any of them answers
+	for _, addr := range addrs {
+		p.AddIPAddr(addr)
+	}
+	if len(addrs) > 1 {
+		log.Printf("Pinging %d addresses of %s", len(addrs), c.cfg.Settings.PingIp)
+	}
+	err = p.AddHandler("receive", func(addr *net.IPAddr, rtt time.Duration) {
+		reply(rtt)
+	})
+	if err != nil {
+		log.Fatalf("error adding receive handler: %v", err)
+	}
+
+	// Add the idle handler, this get called always at the end of a run
+	err = p.AddHandler("idle", handleResult)
+	if err != nil {
+		log.Fatalf("error adding idle handler: %v", err)
+	}
+
+	// Ping loop
+	go func(){
+		for c.isPing(generation) {
+			err = p.Run()
+			if err != nil {
+				log.Fatalf("error while pinging: %v", err)
+			}
+			wait()
+		}
+	}()
+}
+
+// The monotonic clock stands still while the system is suspended, the wall clock does not. How much further the
+// wall clock went since sleptAt than the monotonic time that passed.
+func suspendedFor(sleptAt time.Time, wallNow time.Time, elapsed time.Duration) time.Duration {
+	return wallNow.Sub(sleptAt.Round(0)) - elapsed
+}
+
+// The fades after a suspend are somewhere else, go straight to where the schedule is now
+func (c *Controller) resumeFromSuspend(ctx context.Context, gap time.Duration) {
+	log.Printf("Woke up from a suspend of about %v, recalculating fades", gap.Round(time.Second))
+	c.initSchedule()
+	c.logSchedule()
+	if !c.isPaused && c.currentOverride() == "" {
+		c.rampTo(ctx, c.ComputeScheduledPower(time.Now()))
+	}
+}
+
+// How long the main loop sleeps from now on
+func (c *Controller) loopWait(now time.Time) time.Duration {
+	wait := c.sleepDuration
+	if c.dithering && wait > DITHER_INTERVAL {
+		wait = DITHER_INTERVAL
+	}
+	if c.holdEffect(now) && wait > CHASE_INTERVAL {
+		wait = CHASE_INTERVAL
+	}
+	// During a long fade the brightness only goes a step every few sleeps, wait for the step instead
+	if c.cfg.Settings.SleepUntilChange && !c.dithering && !c.holdEffect(now) {
+		if untilChange := c.untilPowerChange(now); untilChange > wait {
+			wait = untilChange
+		}
+	}
+	if untilDnd := c.untilDoNotDisturbChange(now); untilDnd > 0 && untilDnd < wait {
+		wait = untilDnd
+	}
+	// Wake up right at a fade trigger instead of up to a sleep late
+	if untilFade := c.untilNextFade(now); untilFade > 0 && untilFade < wait {
+		wait = untilFade
+	}
+	return wait
+}
+
+// Go on with a fade that is in progress, finishing it and calculating the next one at its end
+func (c *Controller) runFades(now time.Time) {
+	var power int
+
+	// FadeIn
+	if elapsed := now.Sub(c.fadeInTime); elapsed > 0 && c.events() != "sunrise" {
+		// Calculate brightness with maximum of 255, when there is no fade out the lights may still be on
+		power = c.fadeInPower(elapsed)
+		if c.events() == "sunset" && power < c.power() && elapsed <= time.Duration(c.fadeInSeconds()) * time.Second {
+			power = c.power()
+		}
+
+		// A new night, the sunrise hook may fire again in the morning
+		c.sunriseHookFired = false
+
+		// Set the new brightness
+		c.setGlow(c.dither(power, c.fadeInCurve(elapsed)))
+
+		// Never got to the end of the fade, something is off so finish it
+		if !c.fadeInComplete(elapsed, power) && elapsed > 2 * c.transitionDuration + c.overshootSettle() {
+			log.Printf("Warning: fade in still at %d after %v, finishing it", power, elapsed.Round(time.Second))
+			power = c.holdPower()
+			c.setGlow(power)
+		}
+
+		// If we have complete our fadeIn calculate next fadeIn
+		if c.fadeInComplete(elapsed, power) {
+			c.recordFade("in", c.fadeInTime.Add(time.Duration(c.fadeInSeconds()) * time.Second))
+			c.fadeInTime = c.nextFadeIn(now)
+			log.Printf("The next fadeIn  is %s", c.logTime(c.fadeInTime))
+		}
+	}
+
+	// FadeOut
+	if elapsed := now.Sub(c.fadeOutTime); elapsed > 0 && c.events() != "sunset" {
+		// Calculate brightness with minimum of zero, when there is no fade in only lower what someone else set
+		power = c.fadeOutPower(elapsed)
+		if c.events() == "sunrise" && power > c.power() {
+			power = c.power()
+		}
+		c.checkSunriseHook(power)
+
+		// Set the new brightness
+		c.setGlow(c.dither(power, math.Min(fadeOutLevel(elapsed, c.fadeOutSeconds()), float64(c.holdPower()))))
+
+		// Never got to the end of the fade, something is off so finish it
+		if power > 0 && elapsed > 2 * c.transitionDuration {
+			log.Printf("Warning: fade out still at %d after %v, finishing it", power, elapsed.Round(time.Second))
+			power = 0
+			c.setGlow(power)
+		}
+
+		// If we have complete our fadeIn calculate next fadeIn
+		if power <= 0 {
+			c.recordFade("out", c.fadeOutTime.Add(time.Duration(c.fadeOutSeconds()) * time.Second))
+			c.fadeOutTime = c.nextFadeOut(now)
+			log.Printf("The next fadeOut is %s", c.logTime(c.fadeOutTime))
+			if c.cfg.Settings.SleepWhenOff {
+				c.sleepDevice()
+			}
+		}
+	}
+}
+
+// Switch to the fallback coordinates when needed, see applyFallbackCoordinates
+func (c *Controller) applyFallbackCoordinates(conf *Config) bool {
+	if err := checkCoordinates(conf.Settings.Latitude, conf.Settings.Longitude); err != nil {
+		c.degrade("coordinates", err.Error())
+	} else {
+		c.recover("coordinates")
+	}
+	return applyFallbackCoordinates(conf)
+}
+
+// Every address of the ping host, a load balanced service may have several
+func resolvePingAddrs(host string) ([]*net.IPAddr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []*net.IPAddr{{IP: ip}}, nil
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []*net.IPAddr
+	for _, ip := range ips {
+		addrs = append(addrs, &net.IPAddr{IP: ip})
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no address for %s", host)
+	}
+	return addrs, nil
+}
+
+// Find the local IPv4 address for a source given as address or interface name
+func getPingSource(source string) (string, error) {
+	// An interface name, take its first IPv4 address
+	if net.ParseIP(source) == nil {
+		iface, err := net.InterfaceByName(source)
+		if err != nil {
+			return "", err
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return "", err
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+				return ipnet.IP.String(), nil
+			}
+		}
+		return "", fmt.Errorf("interface %s has no IPv4 address", source)
+	}
+
+	// An address, it has to be one of ours
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", err
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(net.ParseIP(source)) {
+			return source, nil
+		}
+	}
+	return "", fmt.Errorf("address %s does not belong to this host", source)
+}
+
+// How long lights that just came on still have to stay on for the MinOnTime, zero when they may go off
+func (c *Controller) untilMinOnTime() time.Duration {
+	minOn, _ := getDuration(c.cfg.Settings.MinOnTime) // Already validated
+	c.powerLock.Lock()
+	power, onSince := c.currentPower, c.onSince
+	c.powerLock.Unlock()
+	if minOn <= 0 || power == 0 {
+		return 0
+	}
+	if wait := minOn - time.Since(onSince); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+func (c *Controller) pause() {
+	c.pauseLock.Lock()
+	defer c.pauseLock.Unlock()
+	c.pausedByPing = true
+	c.isPaused = true
+
+	// Do quick fade out
+	time.Sleep(time.Second)
+	c.rampTo(c.runContext(), 0)
+}
+
+func (c *Controller) resume() {
+	c.pauseLock.Lock()
+	defer c.pauseLock.Unlock()
+	c.pausedByPing = false
+
+	// Do quick fade in to whatever the schedule wants right now, or the away brightness when nobody is home
+	time.Sleep(time.Second)
+	if c.away {
+		c.rampTo(c.runContext(), int(c.cfg.Settings.PresenceAwayPower))
+	} else {
+		c.isPaused = false
+		c.rampTo(c.runContext(), c.ComputeScheduledPower(time.Now()))
+	}
+
+	// Already at the brightness there is no ramp, the down colour still has to go
+	c.setGlow(c.power())
+}
+
+// Context of Run for the ramps started by the ping check, the presence and the commands, they stop with the daemon
+func (c *Controller) runContext() context.Context {
+	if c.runCtx == nil {
+		return context.Background()
+	}
+	return c.runCtx
+}
+
+// Quickly step the brightness from the current value to the target, always taking the ramp duration however far it is
+func (c *Controller) rampTo(ctx context.Context, target int) {
+	duration, err := getDuration(c.cfg.Settings.RampDuration)
+	if err != nil || duration <= 0 {
+		duration = RAMP_DURATION
+	}
+	c.FadeTo(ctx, uint8(target), duration)
+}
+
+// Come up from dark to the first brightness, a jump straight to it is a visible pop
+func (c *Controller) softStart(ctx context.Context, power int) {
+	duration, _ := getDuration(c.cfg.Settings.SoftStart) // Already validated
+	if duration <= 0 {
+		c.setGlow(power)
+		return
+	}
+	c.setGlow(0)
+	c.FadeTo(ctx, uint8(power), duration)
+}
+
+// Move the brightness from the current value to the target in exactly the given time, with the easing of the fade in
+// on the way up. Stops early when the context is done or another FadeTo takes over, the brightness then stays where
+// it got to.
+func (c *Controller) FadeTo(ctx context.Context, target uint8, over time.Duration) error {
+	c.fadeLock.Lock()
+	c.fadeGeneration++
+	generation := c.fadeGeneration
+	c.fadeLock.Unlock()
+
+	start := c.power()
+	if start == int(target) {
+		return nil
+	}
+
+	begin := time.Now()
+	for {
+		elapsed := time.Since(begin)
+		if elapsed >= over {
+			c.setGlow(int(target))
+			return nil
+		}
+
+		// Calculated from the start every step so rounding does not add up
+		c.setGlow(int(math.Round(c.fadeToLevel(start, int(target), elapsed, over))))
+
+		select {
+			case <- ctx.Done():
+				return ctx.Err()
+			case <- time.After(RAMP_STEP):
+		}
+		if !c.isFade(generation) {
+			return errors.New("Interrupted by another fade")
+		}
+	}
+}
+
+// Whether the FadeTo of this generation is still the latest one
+func (c *Controller) isFade(generation int) bool {
+	c.fadeLock.Lock()
+	defer c.fadeLock.Unlock()
+	return generation == c.fadeGeneration
+}
+
+// Brightness after elapsed of a FadeTo from start to target. Going up with the overshoot easing it rises past the
+// target and settles on it in the last OvershootSettle (at most half) of the time, like the scheduled fade in.
+func (c *Controller) fadeToLevel(start int, target int, elapsed time.Duration, over time.Duration) float64 {
+	settle := c.overshootSettle()
+	if target <= start || settle <= 0 {
+		return float64(start) + float64(target - start) * elapsed.Seconds() / over.Seconds()
+	}
+	if settle > over / 2 {
+		settle = over / 2
+	}
+
+	peak := math.Min(MAX_POWER, float64(target) + float64(c.cfg.Settings.OvershootPeak))
+	rise := over - settle
+	if elapsed < rise {
+		return float64(start) + (peak - float64(start)) * elapsed.Seconds() / rise.Seconds()
+	}
+	progress := (elapsed - rise).Seconds() / settle.Seconds()
+	return peak - (peak - float64(target)) * progress * progress * (3 - 2 * progress)
+}
+
+// Brightness asked for last, the slew may still be on its way there
+func (c *Controller) power() int {
+	c.powerLock.Lock()
+	defer c.powerLock.Unlock()
+	return c.currentPower
+}
+
+// Read the last saved brightness from the state file, falls back to 0 when missing or corrupt
+func (c *Controller) loadState() int {
+	if c.cfg.Settings.StateFile == "" {
+		return 0
+	}
+
+	data, err := ioutil.ReadFile(c.cfg.Settings.StateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Could not read state file, starting dark: %v", err)
+		}
+		return 0
+	}
+
+	power, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || power < 0 || power > MAX_POWER {
+		log.Printf("Corrupt state file %s, starting dark", c.cfg.Settings.StateFile)
+		return 0
+	}
+	return power
+}
+
+// Write the brightness to the state file so a restart can continue where we left off
+func (c *Controller) saveState(power int) {
+	if c.cfg.Settings.StateFile == "" || c.stateUnwritable {
+		return
+	}
+
+	// On a read-only filesystem this will not get better, so warn once and go on without
+	if err := ioutil.WriteFile(c.cfg.Settings.StateFile, []byte(strconv.Itoa(power)), 0644); err != nil {
+		log.Printf("Warning: could not write state file, continuing without persisting the brightness: %v", err)
+		c.stateUnwritable = true
+		c.degrade("state file", err.Error())
+	}
+}
+
+// At the bottom of a fade the steps are visible, alternate between the neighbouring values so over a few frames
+// the exact level shows (when enabled)
+func (c *Controller) dither(power int, level float64) int {
+	if !c.cfg.Settings.Dither || level <= 0 || level >= DITHER_LIMIT {
+		c.dithering = false
+		c.ditherError = 0
+		return power
+	}
+	c.dithering = true
+
+	dithered := math.Floor(level)
+	c.ditherError += level - dithered
+	if c.ditherError >= 1 {
+		c.ditherError--
+		dithered++
+	}
+	return int(dithered)
+}
+
+// Show a brightness, currentPower is the one asked for even while the slew is still on its way there
+func (c *Controller) setGlow(power int) {
+	c.powerLock.Lock()
+	if power > 0 && c.currentPower == 0 {
+		c.onSince = time.Now()
+	}
+	c.currentPower = power
+	c.powerLock.Unlock()
+	c.writeFrame(c.renderFrame(time.Now(), c.slew(power)))
+}
+
+// Brightness to show on the way to the target without changing faster than the MaxSlewRate, the rest of the way is
+// written in steps towards the latest target
+func (c *Controller) slew(target int) int {
+	c.slewLock.Lock()
+	defer c.slewLock.Unlock()
+	c.slewTarget = target
+
+	// Keep following what is shown, so turning the limit on later starts from there
+	rate := c.cfg.Settings.MaxSlewRate
+	if rate <= 0 {
+		c.slewLevel = float64(target)
+		return target
+	}
+
+	// A long time without a change does not save up for a jump
+	now := time.Now()
+	elapsed := now.Sub(c.slewTime)
+	if elapsed > time.Second || c.slewTime.IsZero() {
+		elapsed = time.Second
+	}
+	c.slewTime = now
+
+	step := rate * elapsed.Seconds()
+	if math.Abs(float64(target) - c.slewLevel) <= step {
+		c.slewLevel = float64(target)
+		return target
+	}
+	if float64(target) > c.slewLevel {
+		c.slewLevel += step
+	} else {
+		c.slewLevel -= step
+	}
+
+	if !c.slewPending {
+		c.slewPending = true
+		time.AfterFunc(RAMP_STEP, func() {
+			c.slewLock.Lock()
+			c.slewPending = false
+			target := c.slewTarget
+			c.slewLock.Unlock()
+			c.writeFrame(c.renderFrame(time.Now(), c.slew(target)))
+		})
+	}
+	return int(math.Round(c.slewLevel))
+}
+
+// What the LEDs get for a rendered frame, dark during do not disturb (that goes over everything) and otherwise
+// corrected by the calibration as the very last step
+func outputFrame(f frame, dark bool, table *calibration) frame {
+	if dark {
+		return frame{}
+	}
+	f.calibrate(table)
+	return f
+}
+
+// Write a frame to the PiGlow, skipped when it is exactly what we wrote last time
+func (c *Controller) writeFrame(f frame) {
+	dark := c.doNotDisturb(time.Now())
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	f = outputFrame(f, dark, c.render.calibration)
+
+	// Within the cooldown only the latest frame is kept, it gets written once the cooldown is over
+	cooldown := c.writeCooldown()
+	rateCapped := false
+	if interval := c.minWriteInterval(); interval > cooldown {
+		cooldown = interval
+		rateCapped = true
+	}
+	if wait := cooldown - time.Since(c.lastWrite); cooldown > 0 && wait > 0 {
+		if rateCapped && !c.rateCapLogged {
+			log.Printf("Writing faster than the PiGlow keeps up with (%.0f writes per second), only writing the latest frame", c.maxWriteRate())
+			c.rateCapLogged = true
+		}
+		if !c.pendingFrameValid {
+			time.AfterFunc(wait, c.flushPendingFrame)
+		}
+		c.pendingFrame = f
+		c.pendingFrameValid = true
+		return
+	}
+	c.pendingFrameValid = false
+
+	if c.lastFrameValid && f == c.lastFrame {
+		c.skippedWrites++
+		return
+	}
+	c.applyFrame(f)
+}
+
+// Time all those writes to the PiGlow take, for how fast we can write without it falling behind
+func (c *Controller) measureWriteRate() {
+	if c.cfg.Settings.MaxWriteRate != 0 {
+		return
+	}
+	if _, ok := c.glow.(DryRunGlow); ok {
+		return
+	}
+
+	started := time.Now()
+	for i := 0; i < WRITE_RATE_SAMPLES; i++ {
+		if err := Probe(c.glow); err != nil {
+			log.Printf("Warning: could not measure the write rate: %v", err)
+			return
+		}
+	}
+	c.measuredWriteRate = WRITE_RATE_SAMPLES / time.Since(started).Seconds()
+	log.Printf("The PiGlow takes %.0f writes per second, writing at most %.0f", c.measuredWriteRate, c.maxWriteRate())
+}
+
+// Writes per second we keep to, a configured MaxWriteRate or some margin below the measured one, zero for no limit
+func (c *Controller) maxWriteRate() float64 {
+	if c.cfg.Settings.MaxWriteRate > 0 {
+		return c.cfg.Settings.MaxWriteRate
+	}
+	if c.cfg.Settings.MaxWriteRate < 0 {
+		return 0
+	}
+	return c.measuredWriteRate * WRITE_RATE_MARGIN
+}
+
+// Shortest time between two writes for the maximum write rate
+func (c *Controller) minWriteInterval() time.Duration {
+	rate := c.maxWriteRate()
+	if rate <= 0 {
+		return 0
+	}
+	return time.Duration(float64(time.Second) / rate)
+}
+
+func (c *Controller) writeCooldown() time.Duration {
+	cooldown, _ := getDuration(c.cfg.Settings.WriteCooldown) // Already validated
+	return cooldown
+}
+
+// Writes to the PiGlow that failed in a row
+func (c *Controller) failingWrites() int {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return c.glowFailures
+}
+
+// Write the frame that was held back by the cooldown (or by a failing PiGlow)
+func (c *Controller) flushPendingFrame() {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if !c.pendingFrameValid {
+		return
+	}
+	c.pendingFrameValid = false
+	if c.lastFrameValid && c.pendingFrame == c.lastFrame {
+		c.skippedWrites++
+		return
+	}
+	c.applyFrame(c.pendingFrame)
+}
+
+// Write a frame to the hardware, the caller holds writeLock
+func (c *Controller) applyFrame(f frame) {
+	// Only something to show wakes the device again, e.g. the next fade in or a command
+	if c.deviceAsleep {
+		if f == (frame{}) {
+			c.skippedWrites++
+			return
+		}
+		c.wakeDevice()
+	}
+
+	// Still waiting to try a failing PiGlow again, the retry writes the latest frame
+	if c.glowFailures > 0 && time.Now().Before(c.glowRetryAt) {
+		c.pendingFrame = f
+		c.pendingFrameValid = true
+		return
+	}
+
+	for i, level := range f {
+		c.glow.SetLED(int8(c.render.layout[i]), level)
+	}
+	if err := c.glow.Apply(); err != nil {
+		c.glowFailures++
+		wait := c.glowRetry.next()
+		c.glowRetryAt = time.Now().Add(wait)
+		log.Printf("Warning: could not set PiGlow (%d failures), trying again in %v: %v", c.glowFailures, wait, err)
+		c.degrade("glow", err.Error())
+
+		c.lastFrameValid = false
+		c.pendingFrame = f
+		c.pendingFrameValid = true
+		time.AfterFunc(wait, c.flushPendingFrame)
+		return
+	}
+	if c.glowFailures > 0 {
+		log.Printf("PiGlow works again after %d failures", c.glowFailures)
+		c.glowFailures = 0
+		c.glowRetry.reset()
+		c.recover("glow")
+	}
+	c.lastFrame = f
+	c.lastFrameValid = true
+	c.lastWrite = time.Now()
+
+	if c.cfg.Settings.PreviewImage {
+		c.updatePreview(f)
+	}
+}
+
+// Stop writing to the PiGlow until there is something to show, the bus is released when the PiGlow supports it
+func (c *Controller) sleepDevice() {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if c.deviceAsleep {
+		return
+	}
+	if glow, ok := c.glow.(SleepingGlow); ok {
+		if err := glow.Sleep(); err != nil {
+			log.Printf("Warning: could not put the PiGlow to sleep, only stopping the writes: %v", err)
+		}
+	}
+	c.deviceAsleep = true
+	log.Printf("Lights off, not writing to the PiGlow until the next fade in")
+}
+
+// Take the PiGlow back after sleepDevice, the caller holds writeLock
+func (c *Controller) wakeDevice() {
+	if glow, ok := c.glow.(SleepingGlow); ok {
+		if err := glow.Wake(); err != nil {
+			log.Fatal("Could not wake the PiGlow: ", err)
+		}
+		// What it shows after getting the bus back is unknown
+		c.lastFrameValid = false
+	}
+	c.deviceAsleep = false
+	log.Printf("Writing to the PiGlow again")
+}
+
+// Wake the PiGlow before it is needed, e.g. just before a fade in
+func (c *Controller) wakeDeviceEarly() {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if c.deviceAsleep {
+		c.wakeDevice()
+	}
+}
+
+// Blink a colour a few times to show an abnormal state, afterwards the normal brightness is restored
+func (c *Controller) indicate(status int) {
+	var f frame
+	if err := f.setColour(c.indicatorColour(status), INDICATOR_POWER); err != nil {
+		log.Printf("Could not indicate status: %v", err)
+		return
+	}
+
+	for i := 0; i < 3; i++ {
+		c.writeFrame(f)
+		time.Sleep(time.Millisecond * 200)
+		c.setGlow(c.power())
+		time.Sleep(time.Millisecond * 200)
+	}
+}
+
+// Colour used to indicate a status, configured or the default
+func (c *Controller) indicatorColour(status int) string {
+	switch status {
+		case StatusPingDown:
+			if c.cfg.Settings.PingDownColour != "" {
+				return strings.ToLower(c.cfg.Settings.PingDownColour)
+			}
+			return "red"
+		case StatusConfigError:
+			if c.cfg.Settings.ConfigErrorColour != "" {
+				return strings.ToLower(c.cfg.Settings.ConfigErrorColour)
+			}
+			return "orange"
+	}
+	return "white"
+}
+
+// Write the current state to the log
+func (c *Controller) LogStatus() {
+	log.Printf("Status: %s", c.Status())
+}
@@ -0,0 +1,1305 @@
+package piglowambient
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Records what was written to it instead of driving a PiGlow
+type recordingGlow struct {
+	lock sync.Mutex
+	pending frame
+	frames []frame
+	err error // Returned by Apply instead of writing
+}
+
+func (g *recordingGlow) SetLED(led int8, level uint8) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.pending[led] = level
+}
+
+func (g *recordingGlow) Apply() error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.err != nil {
+		return g.err
+	}
+	g.frames = append(g.frames, g.pending)
+	return nil
+}
+
+func (g *recordingGlow) written() []frame {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return append([]frame{}, g.frames...)
+}
+
+func (g *recordingGlow) last() frame {
+	frames := g.written()
+	if len(frames) == 0 {
+		return frame{}
+	}
+	return frames[len(frames) - 1]
+}
+
+// A configuration that validates, with quick ramps and no limit on the writes
+func testConfig() Config {
+	cfg := DefaultConfig()
+	cfg.Settings.TransitionSpeed = "30m"
+	cfg.Settings.Latitude = 52.37
+	cfg.Settings.Longitude = 4.90
+	cfg.Settings.RampDuration = "1ms"
+	cfg.Settings.MaxWriteRate = -1
+	return cfg
+}
+
+func newTestController(t testing.TB, cfg Config) (*Controller, *recordingGlow) {
+	t.Helper()
+	if err := validateConfig(&cfg); err != nil {
+		t.Fatalf("test configuration does not validate: %v", err)
+	}
+	glow := &recordingGlow{}
+	c := NewDevice(cfg, "", glow)
+	t.Cleanup(func() { c.setRunning(false) })
+	return c, glow
+}
+
+func TestSlewReachesTargetThroughHold(t *testing.T) {
+	cfg := testConfig()
+	cfg.Settings.MaxSlewRate = 100
+	c, glow := newTestController(t, cfg)
+
+	c.setGlow(MAX_POWER)
+	if first := glow.last()[0]; first == 0 || first >= MAX_POWER {
+		t.Fatalf("first write is %d, expected a step of the slew", first)
+	}
+
+	// The main loop renders the held level again every tick, that must not stop the slew partway
+	for i := 0; i < 100; i++ {
+		c.setGlow(c.currentPower)
+		time.Sleep(25 * time.Millisecond)
+	}
+
+	frames := glow.written()
+	for i := 1; i < len(frames); i++ {
+		if frames[i][0] < frames[i - 1][0] {
+			t.Fatalf("write %d went down from %d to %d on the way up", i, frames[i - 1][0], frames[i][0])
+		}
+	}
+	if level := glow.last()[0]; level != MAX_POWER {
+		t.Fatalf("held at %d, expected the slew to reach %d", level, MAX_POWER)
+	}
+}
+
+func TestSlewContinuesByItself(t *testing.T) {
+	cfg := testConfig()
+	cfg.Settings.MaxSlewRate = 100
+	c, glow := newTestController(t, cfg)
+
+	c.setGlow(MAX_POWER)
+	time.Sleep(2 * time.Second)
+	if level := glow.last()[0]; level != MAX_POWER {
+		t.Fatalf("stopped at %d, expected %d", level, MAX_POWER)
+	}
+
+	// And back down without a jump
+	c.setGlow(0)
+	if level := glow.last()[0]; level == 0 {
+		t.Fatalf("went straight to 0")
+	}
+	time.Sleep(3 * time.Second)
+	if level := glow.last()[0]; level != 0 {
+		t.Fatalf("stopped at %d, expected 0", level)
+	}
+}
+
+func TestShowOnceIgnoresSlew(t *testing.T) {
+	cfg := testConfig()
+	cfg.Settings.MaxSlewRate = 1
+	cfg.Curve.Point = []string{"00:00 200", "23:59 200"}
+	c, glow := newTestController(t, cfg)
+
+	c.ShowOnce()
+	if level := glow.last()[0]; level != 200 {
+		t.Fatalf("-once wrote %d, expected the scheduled 200", level)
+	}
+}
+
+func TestSlewDisabledJumps(t *testing.T) {
+	cfg := testConfig()
+	cfg.Settings.MaxSlewRate = 0
+	c, glow := newTestController(t, cfg)
+
+	c.setGlow(MAX_POWER)
+	if level := glow.last()[0]; level != MAX_POWER {
+		t.Fatalf("wrote %d, expected a jump to %d", level, MAX_POWER)
+	}
+}
+
+func TestFadeToTakesTheDuration(t *testing.T) {
+	c, glow := newTestController(t, testConfig())
+
+	begin := time.Now()
+	if err := c.FadeTo(context.Background(), 200, 500 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(begin); took < 500 * time.Millisecond || took > 500 * time.Millisecond + 3 * RAMP_STEP {
+		t.Fatalf("took %v, expected 500ms", took)
+	}
+	if level := glow.last()[0]; level != 200 || c.power() != 200 {
+		t.Fatalf("ended at %d, expected 200", level)
+	}
+
+	// In steps that only go up
+	frames := glow.written()
+	if len(frames) < 5 {
+		t.Fatalf("%d writes, expected steps along the way", len(frames))
+	}
+	for i := 1; i < len(frames); i++ {
+		if frames[i][0] < frames[i - 1][0] {
+			t.Fatalf("write %d went down from %d to %d", i, frames[i - 1][0], frames[i][0])
+		}
+	}
+}
+
+// The pause and resume ramps take the RampDuration for a long way down and a short one alike
+func TestRampTakesTheDurationForAnyDistance(t *testing.T) {
+	cfg := testConfig()
+	cfg.Settings.RampDuration = "300ms"
+	c, glow := newTestController(t, cfg)
+
+	for _, ramp := range []struct{ from, to int }{{255, 0}, {30, 0}, {0, 5}, {100, 110}} {
+		c.setGlow(ramp.from)
+		begin := time.Now()
+		c.rampTo(context.Background(), ramp.to)
+		if took := time.Since(begin); took < 300 * time.Millisecond || took > 300 * time.Millisecond + 3 * RAMP_STEP {
+			t.Errorf("ramp from %d to %d took %v, expected 300ms", ramp.from, ramp.to, took)
+		}
+		if level := int(glow.last()[0]); level != ramp.to {
+			t.Errorf("ramp from %d to %d ended at %d", ramp.from, ramp.to, level)
+		}
+	}
+}
+
+// With a soft start the first write is dark and the brightness ramps up from there, without one it is straight away
+func TestSoftStart(t *testing.T) {
+	cfg := testConfig()
+	cfg.Settings.SoftStart = "300ms"
+	c, glow := newTestController(t, cfg)
+
+	begin := time.Now()
+	c.softStart(context.Background(), 200)
+	if took := time.Since(begin); took < 300 * time.Millisecond {
+		t.Fatalf("took %v, expected 300ms", took)
+	}
+	frames := glow.written()
+	if len(frames) < 3 || frames[0] != (frame{}) || frames[len(frames) - 1] != c.renderFrame(time.Now(), 200) {
+		t.Fatalf("wrote %d frames from %v to %v", len(frames), frames[0], frames[len(frames) - 1])
+	}
+	for i := 1; i < len(frames); i++ {
+		if frames[i][0] < frames[i - 1][0] {
+			t.Fatalf("write %d went down from %d to %d", i, frames[i - 1][0], frames[i][0])
+		}
+	}
+
+	cfg.Settings.SoftStart = ""
+	c, glow = newTestController(t, cfg)
+	c.softStart(context.Background(), 200)
+	if frames := glow.written(); len(frames) != 1 || frames[0] != c.renderFrame(time.Now(), 200) {
+		t.Fatalf("wrote %v without a soft start", frames)
+	}
+}
+
+func TestFadeToCancelled(t *testing.T) {
+	c, glow := newTestController(t, testConfig())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 250 * time.Millisecond)
+	defer cancel()
+	if err := c.FadeTo(ctx, MAX_POWER, time.Second); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, expected the fade to be cancelled", err)
+	}
+
+	// It stays where it got to, about a quarter of the way
+	stopped := glow.last()[0]
+	if stopped < 40 || stopped > 100 || c.power() != int(stopped) {
+		t.Fatalf("stopped at %d (asked for %d), expected about a quarter", stopped, c.power())
+	}
+	time.Sleep(2 * RAMP_STEP)
+	if level := glow.last()[0]; level != stopped {
+		t.Fatalf("went on to %d after the cancel", level)
+	}
+}
+
+func TestFadeToInterrupted(t *testing.T) {
+	c, glow := newTestController(t, testConfig())
+
+	interrupted := make(chan error)
+	go func() { interrupted <- c.FadeTo(context.Background(), MAX_POWER, time.Second) }()
+	time.Sleep(200 * time.Millisecond)
+	if err := c.FadeTo(context.Background(), 0, 200 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := <- interrupted; err == nil {
+		t.Fatal("the first fade was not interrupted")
+	}
+
+	// The first one does not write anymore after the second one is done
+	time.Sleep(2 * RAMP_STEP)
+	if level := glow.last()[0]; level != 0 || c.power() != 0 {
+		t.Fatalf("ended at %d, expected the 0 of the second fade", level)
+	}
+}
+
+// With the overshoot easing a fade up goes past the target and settles on it at the end
+func TestFadeToOvershoot(t *testing.T) {
+	cfg := testConfig()
+	cfg.Settings.FadeInEasing = "overshoot"
+	cfg.Settings.OvershootPeak = 40
+	cfg.Settings.OvershootSettle = "1h"
+	c, _ := newTestController(t, cfg)
+
+	over := 10 * time.Second
+	if level := c.fadeToLevel(0, 100, 4 * time.Second, over); level != 112 {
+		t.Errorf("rising at %v, expected 112", level)
+	}
+	if level := c.fadeToLevel(0, 100, over / 2, over); level != 140 {
+		t.Errorf("peak at %v, expected 140", level)
+	}
+	if level := c.fadeToLevel(0, 100, over, over); math.Abs(level - 100) > 1e-9 {
+		t.Errorf("settled at %v, expected 100", level)
+	}
+	if level := c.fadeToLevel(0, 240, over / 2, over); level != MAX_POWER {
+		t.Errorf("peak at %v, expected it to stop at %d", level, MAX_POWER)
+	}
+
+	// Going down stays linear
+	if level := c.fadeToLevel(200, 100, over / 2, over); level != 150 {
+		t.Errorf("halfway down at %v, expected 150", level)
+	}
+}
+
+// Two devices next to each other, the kitchen PiGlow failing does not stop the bedroom and is tried again
+func TestFailingDeviceKeepsOthersGoing(t *testing.T) {
+	bedroom, bedroomGlow := newTestController(t, testConfig())
+	kitchen, kitchenGlow := newTestController(t, testConfig())
+	kitchenGlow.err = errors.New("remote I/O error")
+
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.Local)
+	bedroom.writeFrame(bedroom.renderFrame(now, 100))
+	kitchen.writeFrame(kitchen.renderFrame(now, 100))
+	if bedroomGlow.last()[0] == 0 {
+		t.Fatal("the bedroom was not written")
+	}
+	if status := kitchen.Status(); status.GlowFailures != 1 || !status.Degraded || !strings.Contains(status.LastError, "remote I/O error") {
+		t.Fatalf("kitchen has %d failures, degraded %v with %q", status.GlowFailures, status.Degraded, status.LastError)
+	}
+	if status := bedroom.Status(); status.GlowFailures != 0 || status.Degraded {
+		t.Fatalf("bedroom has %d failures, degraded %v", status.GlowFailures, status.Degraded)
+	}
+
+	// Within the backoff the kitchen is not tried again, the bedroom goes on
+	bedroom.writeFrame(bedroom.renderFrame(now, 50))
+	kitchen.writeFrame(kitchen.renderFrame(now, 50))
+	if kitchen.failingWrites() != 1 || bedroomGlow.last()[0] >= 100 {
+		t.Fatalf("kitchen has %d failures and the bedroom is at %d", kitchen.failingWrites(), bedroomGlow.last()[0])
+	}
+
+	// Once the kitchen is back the retry writes the latest frame, and it is healthy again
+	kitchenGlow.lock.Lock()
+	kitchenGlow.err = nil
+	kitchenGlow.lock.Unlock()
+	time.Sleep(time.Second + 100 * time.Millisecond)
+	if written := kitchenGlow.written(); len(written) != 1 || written[0] != bedroomGlow.last() {
+		t.Fatalf("kitchen wrote %v after the backoff, expected %v", written, bedroomGlow.last())
+	}
+	if status := kitchen.Status(); status.GlowFailures != 0 || status.Degraded {
+		t.Fatalf("kitchen has %d failures, degraded %v after the retry", status.GlowFailures, status.Degraded)
+	}
+}
+
+// Pinger that answers with the results a test gives it, one run per result
+type fakePinger struct {
+	addrs []*net.IPAddr
+	receive func(*net.IPAddr, time.Duration)
+	idle func()
+	results chan bool
+	handled chan struct{}
+	from int // The address the replies come from
+}
+
+func newFakePinger() *fakePinger {
+	return &fakePinger{results: make(chan bool), handled: make(chan struct{})}
+}
+
+func (p *fakePinger) AddIPAddr(ip *net.IPAddr) {
+	p.addrs = append(p.addrs, ip)
+}
+
+func (p *fakePinger) AddHandler(event string, handler interface{}) error {
+	switch event {
+		case "receive":
+			p.receive = handler.(func(*net.IPAddr, time.Duration))
+		case "idle":
+			p.idle = handler.(func())
+	}
+	return nil
+}
+
+func (p *fakePinger) Source(source string) (string, error) {
+	return source, nil
+}
+
+// Keeps running until the test is over, like the RunLoop of fastping
+func (p *fakePinger) Run() error {
+	for up := range p.results {
+		if up {
+			p.receive(p.addrs[p.from], time.Millisecond)
+		}
+		p.idle()
+		p.handled <- struct{}{}
+	}
+	select {} // The results are closed at the end of the test
+}
+
+// A reply that comes in after the run it belongs to was already over
+func (p *fakePinger) late() {
+	p.receive(p.addrs[0], time.Second)
+}
+
+// Hand the next result to the ping check and wait until it was handled
+func (p *fakePinger) reply(up ...bool) {
+	for _, result := range up {
+		p.results <- result
+		<-p.handled
+	}
+}
+
+// Controller pinging a host through the fake, the host resolves to two addresses
+func newPingController(t *testing.T, cfg Config) (*Controller, *fakePinger) {
+	t.Helper()
+	cfg.Settings.PingIp = "nas.test"
+	c, _ := newTestController(t, cfg)
+	pinger := newFakePinger()
+	c.SetNetwork(func(host string) ([]*net.IPAddr, error) {
+		if host != "nas.test" {
+			return nil, errors.New("no such host")
+		}
+		return []*net.IPAddr{{IP: net.ParseIP("192.0.2.1")}, {IP: net.ParseIP("192.0.2.2")}}, nil
+	}, func() Pinger { return pinger })
+	c.initPing(false)
+	t.Cleanup(func() { close(pinger.results) })
+
+	if len(pinger.addrs) != 2 {
+		t.Fatalf("pinging %v, expected both addresses", pinger.addrs)
+	}
+	return c, pinger
+}
+
+func pingConfig() Config {
+	cfg := testConfig()
+	cfg.Settings.PingUpThreshold = 1
+	cfg.Settings.PingDownThreshold = 2
+	cfg.Settings.PingGracePeriod = ""
+	return cfg
+}
+
+func TestPingDownPausesAndUpResumes(t *testing.T) {
+	c, pinger := newPingController(t, pingConfig())
+
+	pinger.reply(true)
+	if c.pingState != PingUp || c.pausedByPing {
+		t.Fatalf("state %d and paused %v after a reply", c.pingState, c.pausedByPing)
+	}
+
+	// One missed reply is below the threshold
+	pinger.reply(false)
+	if c.pingState != PingUp || c.pausedByPing {
+		t.Fatalf("state %d and paused %v after one missed reply", c.pingState, c.pausedByPing)
+	}
+	pinger.reply(false)
+	if c.pingState != PingDown || !c.pausedByPing {
+		t.Fatalf("state %d and paused %v after two missed replies", c.pingState, c.pausedByPing)
+	}
+
+	pinger.reply(true)
+	if c.pingState != PingUp || c.pausedByPing {
+		t.Fatalf("state %d and paused %v after the host came back", c.pingState, c.pausedByPing)
+	}
+}
+
+// The host is up when any of its addresses answers, the others may stay quiet
+func TestPingAnyAddressUp(t *testing.T) {
+	c, pinger := newPingController(t, pingConfig())
+
+	pinger.from = 1
+	pinger.reply(true, false, true, false)
+	if pausedByPing(c) {
+		t.Fatal("paused with only the second address answering")
+	}
+	pinger.reply(false)
+	if !pausedByPing(c) {
+		t.Fatal("not paused with no address answering")
+	}
+	pinger.from = 0
+	pinger.reply(true)
+	if pausedByPing(c) {
+		t.Fatal("still paused with the first address answering")
+	}
+
+	// An address is pinged as it is
+	if addrs, err := resolvePingAddrs("192.0.2.7"); err != nil || len(addrs) != 1 || !addrs[0].IP.Equal(net.ParseIP("192.0.2.7")) {
+		t.Fatalf("resolved to %v: %v", addrs, err)
+	}
+}
+
+func TestPingFlappingDoesNotPause(t *testing.T) {
+	c, pinger := newPingController(t, pingConfig())
+
+	pinger.reply(true, false, true, false, true, false, true)
+	if c.pingState != PingUp || c.pausedByPing {
+		t.Fatalf("state %d and paused %v after a flapping host", c.pingState, c.pausedByPing)
+	}
+}
+
+// Whether the ping check paused the lights, waits for a pause that is still fading out
+func pausedByPing(c *Controller) bool {
+	c.pauseLock.Lock()
+	defer c.pauseLock.Unlock()
+	return c.pausedByPing
+}
+
+// Paused because the host is down the down colour shows instead of nothing, the resume goes back to the schedule
+func TestDownColour(t *testing.T) {
+	cfg := pingConfig()
+	cfg.Settings.DownColour = "Red"
+	cfg.Settings.DownColourPower = 20
+	c, pinger := newPingController(t, cfg)
+	glow := &recordingGlow{}
+	c.glow = glow
+	c.setGlow(MAX_POWER)
+
+	pinger.reply(true, false, false)
+	if !pausedByPing(c) {
+		t.Fatal("not paused with the host down")
+	}
+	for led, level := range glow.last() {
+		if expected := uint8(0); led % COLOUR_COUNT == 0 && level != 20 || led % COLOUR_COUNT != 0 && level != expected {
+			t.Fatalf("%s of arm %d at %d while the host is down", colours[led % COLOUR_COUNT], led / COLOUR_COUNT, level)
+		}
+	}
+
+	pinger.reply(true)
+	if expected := c.renderFrame(time.Now(), c.ComputeScheduledPower(time.Now())); glow.last() != expected {
+		t.Fatalf("wrote %v after resuming, expected the scheduled %v", glow.last(), expected)
+	}
+}
+
+// Inverted, a reachable host pauses and an unreachable one resumes, through the same thresholds and without the down
+// colour
+func TestPauseOnUp(t *testing.T) {
+	cfg := pingConfig()
+	cfg.Settings.PauseOnUp = true
+	cfg.Settings.PingUpThreshold = 2
+	cfg.Settings.DownColour = "Red"
+	cfg.Settings.DownColourPower = 20
+	c, pinger := newPingController(t, cfg)
+	glow := &recordingGlow{}
+	c.glow = glow
+	c.setGlow(MAX_POWER)
+
+	pinger.reply(true)
+	if pausedByPing(c) {
+		t.Fatal("paused after one reply, below the threshold")
+	}
+	pinger.reply(true)
+	if !pausedByPing(c) || c.Status().PauseReason != "ping up" {
+		t.Fatalf("paused %v for %q with the host up", pausedByPing(c), c.Status().PauseReason)
+	}
+	if glow.last() != (frame{}) {
+		t.Fatalf("wrote %v while the host is up, expected nothing", glow.last())
+	}
+
+	// One missed reply is below the threshold, a reply after it keeps the pause
+	pinger.reply(false, true, false)
+	if !pausedByPing(c) {
+		t.Fatal("resumed after single missed replies")
+	}
+	pinger.reply(false)
+	if pausedByPing(c) || c.Status().PauseReason != "" {
+		t.Fatalf("paused %v for %q with the host down", pausedByPing(c), c.Status().PauseReason)
+	}
+	if expected := c.renderFrame(time.Now(), c.ComputeScheduledPower(time.Now())); glow.last() != expected {
+		t.Fatalf("wrote %v after resuming, expected the scheduled %v", glow.last(), expected)
+	}
+
+	// Coming back needs the threshold again
+	pinger.reply(true, false, true)
+	if pausedByPing(c) {
+		t.Fatal("paused by a flapping host")
+	}
+	pinger.reply(true)
+	if !pausedByPing(c) {
+		t.Fatal("not paused with the host back up")
+	}
+}
+
+func TestPingReplyWithinGracePeriod(t *testing.T) {
+	cfg := pingConfig()
+	cfg.Settings.PingGracePeriod = "300ms"
+	c, pinger := newPingController(t, cfg)
+
+	// Down, but a reply coming in late after the run still counts within the grace period
+	pinger.reply(true, false, false)
+	time.Sleep(100 * time.Millisecond)
+	pinger.late()
+	time.Sleep(400 * time.Millisecond)
+	if pausedByPing(c) {
+		t.Fatal("paused after a reply within the grace period")
+	}
+	c.pingLock.Lock()
+	state := c.pingState
+	c.pingLock.Unlock()
+	if state != PingUp {
+		t.Fatalf("state %d, expected the host to be up again", state)
+	}
+}
+
+func TestPingReplyAfterGracePeriod(t *testing.T) {
+	cfg := pingConfig()
+	cfg.Settings.PingGracePeriod = "300ms"
+	c, pinger := newPingController(t, cfg)
+
+	pinger.reply(true, false, false)
+	if pausedByPing(c) {
+		t.Fatal("paused before the grace period was over")
+	}
+	time.Sleep(400 * time.Millisecond)
+	if !pausedByPing(c) {
+		t.Fatal("not paused after the grace period")
+	}
+
+	// Too late to call it off, the next run with a reply resumes
+	pinger.late()
+	if !pausedByPing(c) {
+		t.Fatal("a reply after the grace period called off the pause")
+	}
+	pinger.reply(true)
+	if pausedByPing(c) {
+		t.Fatal("still paused after the host came back")
+	}
+}
+
+// Lights that only just came on are paused once they were on for the MinOnTime, and not at all when the host comes
+// back before that
+func TestMinOnTime(t *testing.T) {
+	cfg := pingConfig()
+	cfg.Settings.MinOnTime = "300ms"
+	c, pinger := newPingController(t, cfg)
+	c.setGlow(0)
+	c.setGlow(MAX_POWER)
+
+	pinger.reply(true, false, false)
+	if pausedByPing(c) {
+		t.Fatal("paused right after the lights came on")
+	}
+	time.Sleep(500 * time.Millisecond)
+	if !pausedByPing(c) {
+		t.Fatal("not paused after the minimum on time")
+	}
+
+	// Back on, the host returns before the minimum on time is over
+	pinger.reply(true)
+	c.setGlow(0)
+	c.setGlow(MAX_POWER)
+	pinger.reply(false, false)
+	time.Sleep(100 * time.Millisecond)
+	pinger.reply(true)
+	time.Sleep(400 * time.Millisecond)
+	if pausedByPing(c) {
+		t.Fatal("paused although the host came back within the minimum on time")
+	}
+
+	// Lights that were on for longer go off right away
+	pinger.reply(false, false)
+	if !pausedByPing(c) {
+		t.Fatal("not paused with the lights on for longer than the minimum on time")
+	}
+}
+
+func TestPingUnresolvableHost(t *testing.T) {
+	cfg := pingConfig()
+	cfg.Settings.PingIp = "nowhere.test"
+	c, _ := newTestController(t, cfg)
+	c.SetNetwork(func(host string) ([]*net.IPAddr, error) {
+		return nil, errors.New("no such host")
+	}, func() Pinger { return newFakePinger() })
+
+	c.initPing(false)
+	if c.pingState != PingDisabled {
+		t.Fatalf("state %d, expected the ping check to be disabled", c.pingState)
+	}
+	if degraded, lastError, _ := c.Health(); !degraded || !strings.Contains(lastError, "nowhere.test") {
+		t.Fatalf("degraded %v with %q, expected the warning", degraded, lastError)
+	}
+}
+
+func TestPingUnset(t *testing.T) {
+	c, _ := newTestController(t, pingConfig())
+	c.initPing(false)
+	if c.pingState != PingDisabled {
+		t.Fatalf("state %d, expected the ping check to be off", c.pingState)
+	}
+	if degraded, _, _ := c.Health(); degraded {
+		t.Fatal("degraded without a ping IP, that is just off")
+	}
+}
+
+// Required or not, a host that resolves is pinged
+func TestPingValidHostRequired(t *testing.T) {
+	cfg := pingConfig()
+	cfg.Settings.PingIp = "192.0.2.1"
+	cfg.Settings.PingRequired = true
+	c, _ := newTestController(t, cfg)
+	pinger := newFakePinger()
+	defer close(pinger.results)
+	c.SetNetwork(resolvePingAddrs, func() Pinger { return pinger })
+
+	c.initPing(true)
+	if c.pingState != PingUnknown || len(pinger.addrs) != 1 {
+		t.Fatalf("state %d pinging %v, expected the ping check on", c.pingState, pinger.addrs)
+	}
+}
+
+// When the ping check is required a missing or unresolvable host stops the startup, in a process of its own as
+// that exits
+func TestPingRequiredFailsStartup(t *testing.T) {
+	if host, ok := os.LookupEnv("PIGLOW_REQUIRED_PING"); ok {
+		cfg := pingConfig()
+		cfg.Settings.PingIp = host
+		c, _ := newTestController(t, cfg)
+		c.SetNetwork(func(host string) ([]*net.IPAddr, error) {
+			return nil, errors.New("no such host")
+		}, func() Pinger { return newFakePinger() })
+		c.initPing(true)
+		return
+	}
+
+	tests := []struct {
+		host string
+		logged string
+	}{
+		{"", "No ping IP given but the ping check is required"},
+		{"nowhere.test", "error resolving IP address"},
+	}
+	for _, test := range tests {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestPingRequiredFailsStartup$")
+		cmd.Env = append(os.Environ(), "PIGLOW_REQUIRED_PING=" + test.host)
+		output, err := cmd.CombinedOutput()
+		if exit, ok := err.(*exec.ExitError); !ok || exit.Success() {
+			t.Errorf("ping IP %q: got %v, expected the startup to fail", test.host, err)
+		}
+		if !strings.Contains(string(output), test.logged) {
+			t.Errorf("ping IP %q: logged %s", test.host, output)
+		}
+	}
+}
+
+func TestResyncClearsConfigError(t *testing.T) {
+	c, _ := newTestController(t, testConfig())
+	c.started = time.Now()
+
+	// Coordinates that were bad before, fine once the geo source is asked again
+	c.configError = true
+	if _, err := c.resync(); err != nil {
+		t.Fatalf("resync: %v", err)
+	}
+	if c.configError {
+		t.Fatal("still blinking the configuration error with good coordinates")
+	}
+
+	// Bad again, the fallback takes over and that is blinked
+	c.cfg.Settings.Latitude = 91
+	c.cfg.Settings.FallbackLatitude = 52.37
+	c.cfg.Settings.FallbackLongitude = 4.90
+	if _, err := c.resync(); err != nil {
+		t.Fatalf("resync: %v", err)
+	}
+	if !c.configError {
+		t.Fatal("not blinking the configuration error with bad coordinates")
+	}
+}
+
+// Stepping the sleeps of the main loop towards a fade, the first wake up after the trigger is right at it
+func TestLoopWakesAtFadeTrigger(t *testing.T) {
+	c, _ := newTestController(t, testConfig())
+	if c.sleepDuration != time.Second {
+		t.Fatalf("sleeping %v, expected a second", c.sleepDuration)
+	}
+	for _, trigger := range []time.Time{c.fadeInTime, c.fadeOutTime} {
+		now := trigger.Add(-10 * time.Second - 300 * time.Millisecond)
+		for now.Before(trigger) {
+			wait := c.loopWait(now)
+			if wait <= 0 || wait > c.sleepDuration {
+				t.Fatalf("%s: sleeping %v", now, wait)
+			}
+			now = now.Add(wait)
+		}
+		if late := now.Sub(trigger); late > time.Millisecond {
+			t.Errorf("woke up %v after the trigger at %s", late, trigger)
+		}
+	}
+}
+
+// Over a long fade the loop only wakes up when the brightness steps, and every step writes once and on time
+func TestSleepUntilChange(t *testing.T) {
+	for _, sleepUntilChange := range []bool{false, true} {
+		cfg := testConfig()
+		cfg.Settings.TransitionSpeed = "3h"
+		cfg.Settings.SleepUntilChange = sleepUntilChange
+		c, glow := newTestController(t, cfg)
+		c.setGlow(0)
+
+		start := time.Now()
+		c.fadeInTime, c.fadeOutTime = start, start.Add(20 * time.Hour)
+		end := start.Add(c.transitionDuration)
+		writes := len(glow.written()) // Every step is written once, also without sleeping until it
+		wakeups := 0
+		for now := start; c.power() < MAX_POWER && now.Before(end.Add(time.Minute)); wakeups++ {
+			now = now.Add(c.loopWait(now))
+			c.runFades(now)
+			c.setGlow(c.power())
+			if expected := computeFadeInPower(now.Sub(start), c.transitionTime); c.power() != expected {
+				t.Fatalf("sleep until change %v: at %d after %v, expected %d", sleepUntilChange, c.power(), now.Sub(start), expected)
+			}
+		}
+		if writes = len(glow.written()) - writes; writes != MAX_POWER {
+			t.Errorf("sleep until change %v: %d writes for %d steps", sleepUntilChange, writes, MAX_POWER)
+		}
+		if seconds := int(c.transitionDuration.Seconds()); !sleepUntilChange && wakeups < seconds / 2 || sleepUntilChange && wakeups > MAX_POWER + 1 {
+			t.Errorf("sleep until change %v: %d wakeups during the fade", sleepUntilChange, wakeups)
+		}
+	}
+}
+
+// Hours on the wall clock while only a second passed is a suspend, the fades are recalculated from the time after it
+func TestResumeFromSuspend(t *testing.T) {
+	sleptAt := time.Now()
+	if gap := suspendedFor(sleptAt, sleptAt.Round(0).Add(time.Second), time.Second); gap != 0 {
+		t.Fatalf("a normal sleep is a suspend of %v", gap)
+	}
+	gap := suspendedFor(sleptAt, sleptAt.Round(0).Add(5 * time.Hour), time.Second)
+	if gap != 5 * time.Hour - time.Second || gap <= SUSPEND_THRESHOLD {
+		t.Fatalf("suspend of %v", gap)
+	}
+
+	// Fades from before the suspend, long gone by now
+	c, glow := newTestController(t, testConfig())
+	c.fadeInTime = time.Now().Add(-30 * time.Hour)
+	c.fadeOutTime = time.Now().Add(-20 * time.Hour)
+	c.setGlow(MAX_POWER / 3)
+	c.resumeFromSuspend(context.Background(), gap)
+	if !c.fadeInTime.After(time.Now()) || !c.fadeOutTime.After(time.Now()) {
+		t.Fatalf("next fades at %s and %s", c.fadeInTime, c.fadeOutTime)
+	}
+	if power, scheduled := c.power(), c.ComputeScheduledPower(time.Now()); power != scheduled || int(glow.last()[0]) != power {
+		t.Fatalf("at %d (wrote %d) instead of the scheduled %d", power, glow.last()[0], scheduled)
+	}
+}
+
+// A fade that is still going after twice the transition is finished with a warning and the next one is calculated
+func TestStuckFadeFinished(t *testing.T) {
+	fades := []struct {
+		fade string
+		from, to int
+	}{
+		{"in", 0, MAX_POWER},
+		{"out", MAX_POWER, 0},
+	}
+	for _, test := range fades {
+		t.Run(test.fade, func(t *testing.T) {
+			c, glow := newTestController(t, testConfig())
+			logged := captureLog(t)
+			now := time.Now()
+			c.setGlow(test.from)
+
+			// Fade math that thinks the fade takes three times the transition never gets to its end in time
+			c.transitionTime *= 3
+			c.fadeInTime, c.fadeOutTime = now.Add(time.Hour), now.Add(time.Hour)
+			stuck := &c.fadeInTime
+			if test.fade == "out" {
+				stuck = &c.fadeOutTime
+			}
+			*stuck = now.Add(-3 * c.transitionDuration / 2)
+			c.runFades(now)
+			if strings.Contains(logged.String(), "finishing it") || !stuck.Before(now) {
+				t.Fatalf("finished after 1.5 transitions, next at %s", *stuck)
+			}
+
+			*stuck = now.Add(-2 * c.transitionDuration - time.Second)
+			c.runFades(now)
+			if !strings.Contains(logged.String(), "Warning: fade " + test.fade + " still at") {
+				t.Fatalf("no warning in %q", logged.String())
+			}
+			if glow.last()[0] != uint8(test.to) || c.power() != test.to {
+				t.Fatalf("at %d and wrote %d after finishing", c.power(), glow.last()[0])
+			}
+			if !stuck.After(now) {
+				t.Fatalf("the next fade is at %s", *stuck)
+			}
+		})
+	}
+}
+
+// With a single event only its own fade runs, and it only moves the brightness its own way
+func TestEvents(t *testing.T) {
+	tests := []struct {
+		events, fade string
+		from int
+		transitions float64
+		power int
+	}{
+		{"both", "in", 0, 0.5, 128},
+		{"both", "out", MAX_POWER, 0.5, 127},
+		{"sunset", "in", 0, 0.5, 128},
+		{"sunset", "in", 200, 0.5, 200},
+		{"sunset", "out", MAX_POWER, 1.5, MAX_POWER},
+		{"sunrise", "in", 0, 1.5, 0},
+		{"sunrise", "out", MAX_POWER, 0.5, 127},
+		{"sunrise", "out", 100, 0.5, 100},
+	}
+	for _, test := range tests {
+		cfg := testConfig()
+		cfg.Settings.Events = test.events
+		c, _ := newTestController(t, cfg)
+		now := time.Now()
+		c.setGlow(test.from)
+		c.fadeInTime, c.fadeOutTime = now.Add(time.Hour), now.Add(time.Hour)
+		started := now.Add(-time.Duration(test.transitions * float64(c.transitionDuration)))
+		if test.fade == "in" {
+			c.fadeInTime = started
+		} else {
+			c.fadeOutTime = started
+		}
+		c.runFades(now)
+		if c.power() != test.power {
+			t.Errorf("%s: fade %s from %d at %d, expected %d", test.events, test.fade, test.from, c.power(), test.power)
+		}
+	}
+
+	// Halfway through the morning fade out the schedule keeps the lights on with only the sunset, off with only the sunrise
+	for events, expected := range map[string][2]int{"both": {MAX_POWER, 127}, "sunset": {MAX_POWER, MAX_POWER}, "sunrise": {0, 0}} {
+		cfg := testConfig()
+		cfg.Settings.Events = events
+		c, _ := newTestController(t, cfg)
+		night, morning := c.fadeOutTime.Add(-time.Hour), c.fadeOutTime.Add(c.transitionDuration / 2)
+		if power := [2]int{c.ComputeScheduledPower(night), c.ComputeScheduledPower(morning)}; power != expected {
+			t.Errorf("%s: %d at night and %d in the morning, expected %v", events, power[0], power[1], expected)
+		}
+	}
+}
+
+// PiGlow that lets go of the bus while asleep, it counts how often it did
+type sleepingGlow struct {
+	recordingGlow
+	sleeps, wakes int
+}
+
+func (g *sleepingGlow) Sleep() error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.sleeps++
+	return nil
+}
+
+func (g *sleepingGlow) Wake() error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.wakes++
+	return nil
+}
+
+// After the fade out nothing is written to the PiGlow during the night, until there is something to show again
+func TestSleepWhenOff(t *testing.T) {
+	cfg := testConfig()
+	cfg.Settings.SleepWhenOff = true
+	c, _ := newTestController(t, cfg)
+	glow := &sleepingGlow{}
+	c.glow = glow
+	c.setGlow(MAX_POWER)
+
+	now := time.Now()
+	c.fadeInTime, c.fadeOutTime = now.Add(time.Hour), now.Add(-c.transitionDuration - time.Second)
+	c.runFades(now)
+	if c.power() != 0 || !c.Status().DeviceAsleep || glow.sleeps != 1 {
+		t.Fatalf("at %d, asleep %v after %d sleeps", c.power(), c.Status().DeviceAsleep, glow.sleeps)
+	}
+
+	written := len(glow.written())
+	for i := 0; i < 100; i++ {
+		c.setGlow(0)
+	}
+	c.sleepDevice()
+	if len(glow.written()) != written || glow.sleeps != 1 || glow.wakes != 0 {
+		t.Fatalf("%d writes, %d sleeps and %d wakes while off", len(glow.written()) - written, glow.sleeps, glow.wakes)
+	}
+
+	// Something to show, e.g. from a command, wakes it
+	c.setGlow(128)
+	if glow.wakes != 1 || c.Status().DeviceAsleep || glow.last() != c.renderFrame(now, 128) {
+		t.Fatalf("%d wakes, asleep %v and wrote %v", glow.wakes, c.Status().DeviceAsleep, glow.last())
+	}
+}
+
+// A flurry of brightness changes from several goroutines only writes once per cooldown, and the last one always
+// gets written once it is over
+func TestCooldownHammered(t *testing.T) {
+	cfg := testConfig()
+	cfg.Settings.WriteCooldown = "50ms"
+	c, glow := newTestController(t, cfg)
+
+	started := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(offset int) {
+			defer wg.Done()
+			for power := 1; power < 200; power++ {
+				c.setGlow(power + offset)
+				time.Sleep(time.Millisecond)
+			}
+		}(i)
+	}
+	wg.Wait()
+	c.setGlow(77)
+	elapsed := time.Since(started)
+	time.Sleep(150 * time.Millisecond)
+
+	writes := len(glow.written())
+	if most := int(elapsed / (50 * time.Millisecond)) + 2; writes > most {
+		t.Errorf("%d writes in %v, expected at most %d", writes, elapsed, most)
+	}
+	if last := glow.last()[0]; last != 77 {
+		t.Errorf("last write is %d, expected the last brightness asked for", last)
+	}
+}
+
+// At the bottom of a fade the dithered values average out to the level in between, only using the two next to it
+func TestDitherAverage(t *testing.T) {
+	cfg := testConfig()
+	cfg.Settings.Dither = true
+	c, _ := newTestController(t, cfg)
+
+	for _, level := range []float64{0.25, 1.5, 2.7, 4.1, 5.9} {
+		sum := 0
+		for i := 0; i < 1000; i++ {
+			power := c.dither(int(math.Round(level)), level)
+			if power != int(math.Floor(level)) && power != int(math.Floor(level)) + 1 {
+				t.Fatalf("level %v dithered to %d", level, power)
+			}
+			sum += power
+		}
+		if average := float64(sum) / 1000; math.Abs(average - level) > 0.01 {
+			t.Errorf("level %v averages %v", level, average)
+		}
+		if !c.dithering {
+			t.Errorf("level %v is not dithering", level)
+		}
+	}
+
+	// Above the bottom, or with it off, the brightness is left alone
+	if power := c.dither(100, 100.4); power != 100 || c.dithering {
+		t.Errorf("dithered 100 to %d", power)
+	}
+	c.cfg.Settings.Dither = false
+	if power := c.dither(3, 2.5); power != 3 || c.dithering {
+		t.Errorf("dithered 3 to %d with Dither off", power)
+	}
+}
+
+func TestOutputFrame(t *testing.T) {
+	colors := DefaultConfig().Colors
+	colors.RedMax = 100
+	colors.WhiteGamma = 2
+	table := colors.calibration()
+
+	f := outputFrame(uniformFrame(200), false, table)
+	for arm := 0; arm < ARM_COUNT; arm++ {
+		if red := f[arm * COLOUR_COUNT]; red != 100 {
+			t.Errorf("arm %d: red is %d, expected the maximum of 100", arm, red)
+		}
+		if white := f[arm * COLOUR_COUNT + COLOUR_COUNT - 1]; white != 157 {
+			t.Errorf("arm %d: white is %d, expected 157 with a gamma of 2", arm, white)
+		}
+		if green := f[arm * COLOUR_COUNT + 3]; green != 200 {
+			t.Errorf("arm %d: green is %d, expected it unchanged", arm, green)
+		}
+	}
+
+	if f := outputFrame(uniformFrame(200), true, table); f != (frame{}) {
+		t.Errorf("got %v during do not disturb, expected all off", f)
+	}
+}
+
+func TestOneOverrideAtATime(t *testing.T) {
+	c, _ := newTestController(t, testConfig())
+
+	// Commands come in on their own connections, started at the same time only one of them gets the LEDs
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	started := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.startOverride("test", func() { <-release }); err == nil {
+				lock.Lock()
+				started++
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	close(release)
+	if started != 1 {
+		t.Fatalf("%d overrides started, expected one", started)
+	}
+
+	// Free again once it is over
+	err := c.startOverride("again", func() {})
+	for i := 0; i < 100 && err != nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		err = c.startOverride("again", func() {})
+	}
+	if err != nil {
+		t.Fatalf("still taken after the override finished: %v", err)
+	}
+}
+
+// Log output of the test, written from every goroutine
+type logCapture struct {
+	lock sync.Mutex
+	buf strings.Builder
+}
+
+func (l *logCapture) Write(p []byte) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.buf.Write(p)
+}
+
+func (l *logCapture) String() string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.buf.String()
+}
+
+func captureLog(t *testing.T) *logCapture {
+	t.Helper()
+	capture := &logCapture{}
+	log.SetOutput(capture)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return capture
+}
+
+// A reload only restarts what the changed settings are used by, and logs what that was
+func TestReloadRestartsWhatChanged(t *testing.T) {
+	tests := []struct {
+		name string
+		change func(*Config)
+		ping bool
+		schedule bool
+		logged string
+	}{
+		{"schedule", func(cfg *Config) { cfg.Settings.Latitude = 59.91 }, false, true, "recalculating fades"},
+		{"transition", func(cfg *Config) { cfg.Settings.TransitionSpeed = "1h" }, false, true, "recalculating fades"},
+		{"device", func(cfg *Config) { cfg.Settings.ActiveArm = "1" }, false, false, "Nothing that needs a restart changed"},
+		{"ping target", func(cfg *Config) { cfg.Settings.PingIp = "other.test" }, true, false, "restarting ping check"},
+		{"ping threshold", func(cfg *Config) { cfg.Settings.PingDownThreshold = 5 }, true, false, "restarting ping check"},
+		{"nothing", func(cfg *Config) {}, false, false, "Nothing that needs a restart changed"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, _ := newPingController(t, pingConfig())
+			c.pingLock.Lock()
+			generation := c.pingGeneration
+			c.pingLock.Unlock()
+			logged := captureLog(t)
+
+			newCfg := c.cfg
+			test.change(&newCfg)
+			if err := c.Reload(newCfg); err != nil {
+				t.Fatal(err)
+			}
+			if restarted := !c.isPing(generation); restarted != test.ping {
+				t.Errorf("ping check restarted %v", restarted)
+			}
+			if c.scheduleChanged != test.schedule {
+				t.Errorf("schedule changed %v", c.scheduleChanged)
+			}
+			if !strings.Contains(logged.String(), test.logged) {
+				t.Errorf("logged %q, expected %q", logged.String(), test.logged)
+			}
+		})
+	}
+
+	// The device settings do get used, without a restart
+	c, _ := newTestController(t, testConfig())
+	newCfg := c.cfg
+	newCfg.Settings.ActiveArm = "1"
+	if err := c.Reload(newCfg); err != nil {
+		t.Fatal(err)
+	}
+	if c.render.arm != 1 {
+		t.Errorf("active arm %d after the reload", c.render.arm)
+	}
+}
+
+func TestReloadMovesControlSocket(t *testing.T) {
+	dir := t.TempDir()
+	cfg := testConfig()
+	cfg.Settings.ControlSocket = filepath.Join(dir, "old.sock")
+	c, _ := newTestController(t, cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c.runCtx = ctx
+	c.started = time.Now()
+	c.startControl(true)
+
+	answers := func(path string) bool {
+		for i := 0; i < 50; i++ {
+			if conn, err := net.Dial("unix", path); err == nil {
+				defer conn.Close()
+				fmt.Fprintln(conn, "dnd")
+				reply, _ := bufio.NewReader(conn).ReadString('\n')
+				return reply != ""
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+	if !answers(cfg.Settings.ControlSocket) {
+		t.Fatal("no answer on the control socket")
+	}
+
+	moved := cfg
+	moved.Settings.ControlSocket = filepath.Join(dir, "new.sock")
+	if err := c.Reload(moved); err != nil {
+		t.Fatal(err)
+	}
+	if !answers(moved.Settings.ControlSocket) {
+		t.Fatal("no answer on the new control socket")
+	}
+	// The old one is closed by its own goroutine, give it a moment
+	for i := 0; ; i++ {
+		conn, err := net.Dial("unix", cfg.Settings.ControlSocket)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if i == 50 {
+			t.Fatal("still listening on the old control socket")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Rotated by an arm every logical LED lands on the same LED of the next arm, the layout has to have every LED once
+func TestRotatedLayout(t *testing.T) {
+	cfg := testConfig()
+	var order []string
+	for led := 0; led < LED_COUNT; led++ {
+		order = append(order, fmt.Sprint((led + COLOUR_COUNT) % LED_COUNT))
+	}
+	cfg.Layout.Order = strings.Join(order, " ")
+	c, glow := newTestController(t, cfg)
+
+	var f frame
+	for led := range f {
+		f[led] = uint8(led + 1)
+	}
+	c.writeLock.Lock()
+	c.applyFrame(f)
+	c.writeLock.Unlock()
+	written := glow.last()
+	for led := range f {
+		if physical := (led + COLOUR_COUNT) % LED_COUNT; written[physical] != f[led] {
+			t.Errorf("logical LED %d: physical LED %d at %d, expected %d", led, physical, written[physical], f[led])
+		}
+	}
+
+	if layout, err := parseLayout(""); err != nil || layout[0] != 0 || layout[LED_COUNT - 1] != LED_COUNT - 1 {
+		t.Errorf("default layout %v: %v", layout, err)
+	}
+	for _, bad := range []string{
+		"0 1 2",
+		strings.Join(order[:LED_COUNT - 1], " ") + " 18",
+		strings.Join(order[:LED_COUNT - 1], " ") + " " + order[0],
+		strings.Join(order[:LED_COUNT - 1], " ") + " x",
+	} {
+		if _, err := parseLayout(bad); err == nil {
+			t.Errorf("no error for layout `%s`", bad)
+		}
+	}
+}
+
+// Writing a frame to the PiGlow, with a rotated layout
+func BenchmarkApplyFrame(b *testing.B) {
+	cfg := testConfig()
+	var order []string
+	for led := 0; led < LED_COUNT; led++ {
+		order = append(order, fmt.Sprint((led + COLOUR_COUNT) % LED_COUNT))
+	}
+	cfg.Layout.Order = strings.Join(order, " ")
+	c, _ := newTestController(b, cfg)
+	c.glow = DryRunGlow{}
+	f := uniformFrame(128)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.writeLock.Lock()
+		c.applyFrame(f)
+		c.writeLock.Unlock()
+	}
+}
+
+func TestSetTransitionSpeed(t *testing.T) {
+	c, _ := newTestController(t, testConfig())
+
+	// Zero switches instantly, like in the configuration file
+	if reply := c.Command("set transitionspeed 0"); !strings.HasPrefix(reply, "transition speed set to 0") {
+		t.Fatalf("got `%s`, expected a zero transition to be accepted", reply)
+	}
+	if reply := c.Command("get transitionspeed"); reply != "0" || !c.scheduleChanged {
+		t.Fatalf("got `%s`, schedule changed %v", reply, c.scheduleChanged)
+	}
+	c.initSchedule() // Like the main loop does next
+	if c.transitionDuration != 0 {
+		t.Fatalf("transition of %v", c.transitionDuration)
+	}
+	if reply := c.Command("set transitionspeed 1 h"); !strings.HasPrefix(reply, "transition speed set to 1h") {
+		t.Fatalf("got `%s`", reply)
+	}
+
+	// What the configuration file rejects is rejected here, without counting as a broken configuration
+	for _, speed := range []string{"-5m", "soon", "20h"} {
+		c.Command("set transitionspeed " + speed)
+		if c.cfg.Settings.TransitionSpeed != "1h" || c.configError {
+			t.Errorf("%s: transition speed is %s, configuration error %v", speed, c.cfg.Settings.TransitionSpeed, c.configError)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package piglowambient
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const GEO_CACHE_TIME = 24 * time.Hour
+const GEO_IP_URL = "http://ip-api.com/json"
+const GPSD_ADDRESS = "localhost:2947"
+
+// Last coordinates resolved from a geo source, so a reload does not do a lookup every time. The retry runs in the
+// background, so everything is guarded by the lock.
+type geoCache struct {
+	lock sync.Mutex
+	source string
+	latitude float64
+	longitude float64
+	time time.Time
+	wanted string // Source of the current configuration, a retry for another one stops
+	retrying bool
+}
+
+// Coordinates a retry found, handed to the main loop as only that changes the configuration
+type geoResult struct {
+	source string
+	latitude float64
+	longitude float64
+}
+
+// Replace the configured coordinates by the ones of the geo source, if any
+func (c *Controller) applyGeoSource(conf *Config) {
+	source := strings.ToLower(strings.TrimSpace(conf.Settings.GeoSource))
+	if source == "" {
+		c.recover("geo")
+		return
+	}
+
+	// Use the cache when it is still fresh
+	c.geoCache.lock.Lock()
+	c.geoCache.wanted = source
+	fresh := c.geoCache.source == source && time.Since(c.geoCache.time) < GEO_CACHE_TIME
+	if fresh {
+		conf.Settings.Latitude = c.geoCache.latitude
+		conf.Settings.Longitude = c.geoCache.longitude
+	}
+	c.geoCache.lock.Unlock()
+	if fresh {
+		return
+	}
+
+	latitude, longitude, err := lookupGeoSource(source, conf)
+	if err != nil {
+		log.Printf("Could not get coordinates from %s, using the configured ones: %v", source, err)
+		c.degrade("geo", fmt.Sprintf("could not get coordinates from %s: %v", source, err))
+		go c.retryGeoSource(source, *conf)
+		return
+	}
+
+	log.Printf("Coordinates from %s: latitude %f, longitude %f", source, latitude, longitude)
+	c.recover("geo")
+	c.cacheGeo(source, latitude, longitude)
+	conf.Settings.Latitude = latitude
+	conf.Settings.Longitude = longitude
+}
+
+// Keep trying a failed geo source in the background, the main loop moves the schedule once it works. The retry
+// has its own copy of the configuration it was started with.
+func (c *Controller) retryGeoSource(source string, conf Config) {
+	c.geoCache.lock.Lock()
+	if c.geoCache.retrying {
+		c.geoCache.lock.Unlock()
+		return
+	}
+	c.geoCache.retrying = true
+	c.geoCache.lock.Unlock()
+	defer func() {
+		c.geoCache.lock.Lock()
+		c.geoCache.retrying = false
+		c.geoCache.lock.Unlock()
+	}()
+
+	initialInterval, _ := getDuration(conf.Settings.GeoRetryInitial)
+	maxInterval, _ := getDuration(conf.Settings.GeoRetryMax)
+	b := newBackoff(initialInterval, maxInterval)
+	for c.running() {
+		time.Sleep(b.next())
+
+		// Stop when the configuration no longer wants this source
+		if c.wantedGeoSource() != source {
+			return
+		}
+
+		latitude, longitude, err := lookupGeoSource(source, &conf)
+		if err != nil {
+			continue
+		}
+
+		log.Printf("Coordinates from %s after retrying: latitude %f, longitude %f", source, latitude, longitude)
+		c.recover("geo")
+		c.cacheGeo(source, latitude, longitude)
+
+		// One is waiting already when the main loop did not get to it, it is picked up from the cache then
+		select {
+			case c.geoFound <- geoResult{source: source, latitude: latitude, longitude: longitude}:
+			default:
+		}
+		return
+	}
+}
+
+// Move the schedule to the coordinates a retry found, from the main loop
+func (c *Controller) useGeoResult(found geoResult) {
+	if strings.ToLower(strings.TrimSpace(c.cfg.Settings.GeoSource)) != found.source {
+		return
+	}
+	c.cfg.Settings.Latitude = found.latitude
+	c.cfg.Settings.Longitude = found.longitude
+	c.scheduleChanged = true
+}
+
+// The geo source of the current configuration
+func (c *Controller) wantedGeoSource() string {
+	c.geoCache.lock.Lock()
+	defer c.geoCache.lock.Unlock()
+	return c.geoCache.wanted
+}
+
+// Whether a failed geo source is being retried
+func (c *Controller) geoRetrying() bool {
+	c.geoCache.lock.Lock()
+	defer c.geoCache.lock.Unlock()
+	return c.geoCache.retrying
+}
+
+func (c *Controller) cacheGeo(source string, latitude float64, longitude float64) {
+	c.geoCache.lock.Lock()
+	defer c.geoCache.lock.Unlock()
+	c.geoCache.source = source
+	c.geoCache.latitude = latitude
+	c.geoCache.longitude = longitude
+	c.geoCache.time = time.Now()
+}
+
+// Ask the geo source for the coordinates
+func lookupGeoSource(source string, conf *Config) (float64, float64, error) {
+	switch source {
+		case "ip":
+			return lookupIpLocation(conf.Settings.httpTimeout())
+		case "gpsd":
+			addr := conf.Settings.GpsdAddress
+			if addr == "" {
+				addr = GPSD_ADDRESS
+			}
+			return lookupGpsd(addr)
+	}
+	return 0, 0, fmt.Errorf("Geo source `%s` given, but is not supported", source)
+}
+
+// Approximate coordinates based on our public IP address
+func lookupIpLocation(timeout time.Duration) (float64, float64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", GEO_IP_URL, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Status string
+		Message string
+		Lat float64
+		Lon float64
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, 0, err
+	}
+	if result.Status != "success" {
+		return 0, 0, fmt.Errorf("lookup failed: %s", result.Message)
+	}
+	return result.Lat, result.Lon, nil
+}
+
+// Coordinates from the first position report with a fix of a local gpsd
+func lookupGpsd(addr string) (float64, float64, error) {
+	conn, err := net.DialTimeout("tcp", addr, 5 * time.Second)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	if _, err := conn.Write([]byte("?WATCH={\"enable\":true,\"json\":true}\n")); err != nil {
+		return 0, 0, err
+	}
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var report struct {
+			Class string
+			Mode int
+			Lat float64
+			Lon float64
+		}
+		if json.Unmarshal(scanner.Bytes(), &report) != nil {
+			continue
+		}
+
+		// Mode 2 and up means we have a 2D or 3D fix
+		if report.Class == "TPV" && report.Mode >= 2 {
+			return report.Lat, report.Lon, nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return 0, 0, err
+	}
+	return 0, 0, errors.New("gpsd closed the connection without a fix")
+}
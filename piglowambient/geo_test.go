@@ -0,0 +1,81 @@
+package piglowambient
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// Local gpsd that has no fix for the first connections, then reports one
+func fakeGpsd(t *testing.T, withoutFix int, latitude float64, longitude float64) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for connections := 0; ; connections++ {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			bufio.NewReader(conn).ReadString('\n') // The WATCH
+			if connections >= withoutFix {
+				fmt.Fprintf(conn, "{\"class\":\"TPV\",\"mode\":3,\"lat\":%f,\"lon\":%f}\n", latitude, longitude)
+			}
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// A failed lookup is retried in the background, the coordinates it finds only change the configuration in the main
+// loop (run with -race)
+func TestGeoRetryThroughMainLoop(t *testing.T) {
+	cfg := testConfig()
+	cfg.Settings.GeoSource = "gpsd"
+	cfg.Settings.GpsdAddress = fakeGpsd(t, 2, 48.85, 2.35)
+	cfg.Settings.GeoRetryInitial = "10ms"
+	cfg.Settings.GeoRetryMax = "20ms"
+	c, _ := newTestController(t, cfg)
+	if degraded, _, _ := c.Health(); !degraded || c.cfg.Settings.Latitude != 52.37 {
+		t.Fatalf("degraded %v and latitude %f after the failed lookup", degraded, c.cfg.Settings.Latitude)
+	}
+
+	var found geoResult
+	select {
+		case found = <- c.geoFound:
+		case <- time.After(5 * time.Second):
+			t.Fatal("the retry did not find the coordinates")
+	}
+	if c.cfg.Settings.Latitude != 52.37 {
+		t.Fatalf("the retry changed the latitude to %f itself", c.cfg.Settings.Latitude)
+	}
+	c.useGeoResult(found)
+	if c.cfg.Settings.Latitude != 48.85 || c.cfg.Settings.Longitude != 2.35 || !c.scheduleChanged {
+		t.Fatalf("at %f, %f with schedule changed %v", c.cfg.Settings.Latitude, c.cfg.Settings.Longitude, c.scheduleChanged)
+	}
+	if degraded, _, _ := c.Health(); degraded {
+		t.Fatal("still degraded after the retry worked")
+	}
+
+	// A reload gets them from the cache
+	reloaded := cfg
+	c.applyGeoSource(&reloaded)
+	if reloaded.Settings.Latitude != 48.85 || reloaded.Settings.Longitude != 2.35 {
+		t.Fatalf("reloaded at %f, %f", reloaded.Settings.Latitude, reloaded.Settings.Longitude)
+	}
+}
+
+// Coordinates of a source the configuration no longer uses are left alone
+func TestGeoResultOfOtherSource(t *testing.T) {
+	c, _ := newTestController(t, testConfig())
+	c.useGeoResult(geoResult{source: "gpsd", latitude: 48.85, longitude: 2.35})
+	if c.cfg.Settings.Latitude != 52.37 || c.scheduleChanged {
+		t.Fatalf("moved to latitude %f", c.cfg.Settings.Latitude)
+	}
+}
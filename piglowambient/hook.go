@@ -0,0 +1,166 @@
+package piglowambient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const HOOK_TIMEOUT = 30 * time.Second
+const HTTP_TIMEOUT = 10 * time.Second
+const WEBHOOK_ATTEMPTS = 3
+const WEBHOOK_MAX_PENDING = 8
+const HOOK_RETRY_INITIAL = 5 * time.Second
+const HOOK_RETRY_MAX = 2 * time.Minute
+
+// Shared by every outgoing request so the connections are kept open and reused, how long a request may take comes
+// from its context
+var httpClient = &http.Client{Transport: &http.Transport{
+	Proxy: http.ProxyFromEnvironment,
+	DialContext: (&net.Dialer{Timeout: HTTP_TIMEOUT, KeepAlive: 30 * time.Second}).DialContext,
+	MaxIdleConns: 10,
+	MaxIdleConnsPerHost: 2,
+	IdleConnTimeout: 90 * time.Second,
+	TLSHandshakeTimeout: HTTP_TIMEOUT,
+}}
+
+// Events still being sent, a slow webhook should not pile up goroutines while the ping flaps
+var webhookSlots = make(chan struct{}, WEBHOOK_MAX_PENDING)
+
+// How long an outgoing request may take
+func (settings *Settings) httpTimeout() time.Duration {
+	timeout, err := getDuration(settings.HttpTimeout)
+	if err != nil || timeout <= 0 {
+		return HTTP_TIMEOUT
+	}
+	return timeout
+}
+
+// Fire the sunrise hook once when the morning fade passes the configured brightness
+func (c *Controller) checkSunriseHook(power int) {
+	if c.cfg.Settings.SunriseHook == "" || c.sunriseHookFired || power > int(c.cfg.Settings.SunriseHookPower) {
+		return
+	}
+	c.sunriseHookFired = true
+
+	timeout, err := getDuration(c.cfg.Settings.SunriseHookTimeout)
+	if err != nil || timeout <= 0 {
+		timeout = HOOK_TIMEOUT
+	}
+	window, _ := getDuration(c.cfg.Settings.SunriseHookRetry) // Already validated
+	go c.retrySunriseHook(c.cfg.Settings.SunriseHook, timeout, window)
+}
+
+// Run the sunrise hook, a failing one is tried again with a backoff for the retry window. It stays marked as fired
+// while retrying so it runs at most once, a new night stops the retries.
+func (c *Controller) retrySunriseHook(hook string, timeout time.Duration, window time.Duration) {
+	deadline := time.Now().Add(window)
+	b := newBackoff(HOOK_RETRY_INITIAL, HOOK_RETRY_MAX)
+	for {
+		if runHook("sunrise", hook, timeout) == nil || window <= 0 {
+			return
+		}
+		wait := b.next()
+		if time.Now().Add(wait).After(deadline) {
+			log.Printf("Giving up on the sunrise hook after retrying for %v", window)
+			return
+		}
+		log.Printf("Trying the sunrise hook again in %v", wait.Round(time.Second))
+		time.Sleep(wait)
+		if !c.running() || !c.sunriseHookFired {
+			return
+		}
+	}
+}
+
+// Run a hook, an http(s) URL gets a POST and anything else is a shell command
+func runHook(name string, hook string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var err error
+	if strings.HasPrefix(hook, "http://") || strings.HasPrefix(hook, "https://") {
+		err = postHook(ctx, hook)
+	} else {
+		err = exec.CommandContext(ctx, "/bin/sh", "-c", hook).Run()
+	}
+
+	if err != nil {
+		log.Printf("The %s hook failed: %v", name, err)
+		return err
+	}
+	log.Printf("The %s hook ran successfully", name)
+	return nil
+}
+
+// Tell the webhook about an event in the background, a few attempts are made before giving up
+func (c *Controller) sendEvent(event string, detail string) {
+	if c.cfg.Settings.WebhookUrl == "" {
+		return
+	}
+
+	body, err := json.Marshal(struct {
+		Event string `json:"event"`
+		Time time.Time `json:"time"`
+		Detail string `json:"detail"`
+	}{event, time.Now(), detail})
+	if err != nil {
+		log.Printf("Could not encode %s event: %v", event, err)
+		return
+	}
+
+	select {
+		case webhookSlots <- struct{}{}:
+		default:
+			log.Printf("Too many events waiting for the webhook, dropping the %s event", event)
+			return
+	}
+
+	go func(url string, timeout time.Duration) {
+		defer func() { <-webhookSlots }()
+		b := newBackoff(time.Second, 30 * time.Second)
+		for attempt := 1; ; attempt++ {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			err := postJson(ctx, url, body)
+			cancel()
+			if err == nil {
+				return
+			}
+			if attempt >= WEBHOOK_ATTEMPTS {
+				log.Printf("Giving up sending %s event to the webhook: %v", event, err)
+				return
+			}
+			time.Sleep(b.next())
+		}
+	}(c.cfg.Settings.WebhookUrl, c.cfg.Settings.httpTimeout())
+}
+
+func postHook(ctx context.Context, url string) error {
+	return postJson(ctx, url, nil)
+}
+
+func postJson(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package piglowambient
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Run a failing sunrise hook that counts its runs in a file
+func runFailingHook(t *testing.T, window time.Duration) int {
+	t.Helper()
+	c, _ := newTestController(t, testConfig())
+	c.sunriseHookFired = true
+	path := filepath.Join(t.TempDir(), "runs")
+
+	started := time.Now()
+	c.retrySunriseHook("echo run >> " + path + "; exit 1", time.Second, window)
+	if elapsed := time.Since(started); elapsed > 2 * time.Second {
+		t.Fatalf("took %v without retrying", elapsed)
+	}
+	runs, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Count(string(runs), "run")
+}
+
+func TestSunriseHookWithoutRetry(t *testing.T) {
+	if runs := runFailingHook(t, 0); runs != 1 {
+		t.Fatalf("ran %d times, expected once", runs)
+	}
+}
+
+func TestSunriseHookRetryWindowTooShort(t *testing.T) {
+	// The first retry would be after the window, so it gives up right away
+	if runs := runFailingHook(t, HOOK_RETRY_INITIAL - time.Second); runs != 1 {
+		t.Fatalf("ran %d times, expected once", runs)
+	}
+}
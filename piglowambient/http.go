@@ -0,0 +1,209 @@
+package piglowambient
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const PREVIEW_SIZE = 160
+
+// Colour of every ring at full brightness, in ring order
+var previewColours = [COLOUR_COUNT]color.RGBA{
+	{255, 0, 0, 255},
+	{255, 128, 0, 255},
+	{255, 255, 0, 255},
+	{0, 255, 0, 255},
+	{0, 128, 255, 255},
+	{255, 255, 255, 255},
+}
+
+// Serve the HTTP endpoints until the context is done, not being able to listen is only fatal when required
+func (c *Controller) serveHttp(ctx context.Context, address string, required bool) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/preview.png", c.handlePreview)
+	mux.HandleFunc("/status", c.handleStatus)
+	mux.HandleFunc("/healthz", c.handleHealth)
+	mux.HandleFunc("/reload", c.handleReload)
+	mux.HandleFunc("/logs", c.handleLogs)
+	mux.HandleFunc("/schedule.ics", c.handleCalendar)
+
+	listener, err := listenRetrying("tcp", address)
+	if err != nil {
+		if required {
+			log.Fatalf("error listening for HTTP: %v", err)
+		}
+		log.Printf("Warning: could not listen for HTTP on %s: %v", address, err)
+		return
+	}
+
+	server := &http.Server{Handler: mux, ReadTimeout: CONTROL_TIMEOUT, WriteTimeout: CONTROL_TIMEOUT}
+	go func() {
+		<- ctx.Done()
+		server.Close()
+	}()
+
+	log.Printf("Listening for HTTP on %s", address)
+	if err := server.Serve(listener); err != nil && ctx.Err() == nil {
+		log.Printf("Warning: stopped serving HTTP on %s: %v", address, err)
+	}
+}
+
+// The status as JSON
+func (c *Controller) handleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintln(w, c.Status().JSON())
+}
+
+// Whether we are alive, degraded counts as failing when asked for
+func (c *Controller) handleHealth(w http.ResponseWriter, r *http.Request) {
+	degraded, lastError, _ := c.Health()
+	if degraded && c.cfg.Settings.UnhealthyWhenDegraded {
+		http.Error(w, "degraded: " + lastError, http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// Same as the reload command, only on a POST so a crawler or a preview does not reload. Like the control socket
+// only this machine may reload, the other endpoints only read.
+func (c *Controller) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST to reload", http.StatusMethodNotAllowed)
+		return
+	}
+	if !fromLoopback(r) {
+		http.Error(w, "reloading is only allowed from this machine", http.StatusForbidden)
+		return
+	}
+	if err := c.reloadOnRequest(); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	fmt.Fprintln(w, "configuration reloaded")
+}
+
+// Whether the request comes from this machine
+func fromLoopback(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// The last log lines as text, ?n= for how many
+func (c *Controller) handleLogs(w http.ResponseWriter, r *http.Request) {
+	n := LOG_TAIL_LINES
+	if str := r.URL.Query().Get("n"); str != "" {
+		var err error
+		if n, err = strconv.Atoi(str); err != nil || n <= 0 {
+			http.Error(w, "n has to be a number of lines", http.StatusBadRequest)
+			return
+		}
+	}
+	lines, err := c.logTail(n)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+}
+
+// The fades of the coming week as an iCalendar file
+func (c *Controller) handleCalendar(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	if err := c.writeCalendar(w, time.Now()); err != nil {
+		log.Printf("Could not write the calendar: %v", err)
+	}
+}
+
+// The PNG of the last written frame, rendered under the write lock and served from the HTTP goroutines
+type previewImage struct {
+	lock sync.Mutex
+	data []byte
+}
+
+func (p *previewImage) get() []byte {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.data
+}
+
+func (p *previewImage) set(data []byte) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.data = data
+}
+
+// The last frame as an image, only rendered when PreviewImage is enabled
+func (c *Controller) handlePreview(w http.ResponseWriter, r *http.Request) {
+	data := c.previewImage.get()
+	if data == nil {
+		http.Error(w, "PreviewImage is not enabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(data)
+}
+
+// Keep the preview image of a written frame ready to serve
+func (c *Controller) updatePreview(f frame) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, renderPreview(f)); err != nil {
+		log.Printf("Could not render preview image: %v", err)
+		return
+	}
+	c.previewImage.set(buf.Bytes())
+}
+
+// Draw the LEDs where they sit on the PiGlow, the three arms point out from the center with red on the outside
+func renderPreview(f frame) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, PREVIEW_SIZE, PREVIEW_SIZE))
+	for i := range img.Pix {
+		if i % 4 == 3 {
+			img.Pix[i] = 255
+		}
+	}
+
+	center := float64(PREVIEW_SIZE) / 2
+	for led, level := range f {
+		arm := led / COLOUR_COUNT
+		ring := led % COLOUR_COUNT
+		angle := -math.Pi / 2 + float64(arm) * 2 * math.Pi / ARM_COUNT
+		distance := center - 10 - float64(ring) * (center - 20) / COLOUR_COUNT
+		x := center + distance * math.Cos(angle)
+		y := center + distance * math.Sin(angle)
+
+		base := previewColours[ring]
+		scale := func(v uint8) uint8 { return uint8(uint32(v) * uint32(level) / MAX_POWER) }
+		drawDot(img, x, y, 5, color.RGBA{scale(base.R), scale(base.G), scale(base.B), 255})
+	}
+	return img
+}
+
+// Fill a circle around x,y
+func drawDot(img *image.RGBA, x float64, y float64, radius float64, col color.RGBA) {
+	for py := int(y - radius); py <= int(y + radius); py++ {
+		for px := int(x - radius); px <= int(x + radius); px++ {
+			if math.Hypot(float64(px) - x, float64(py) - y) <= radius {
+				img.SetRGBA(px, py, col)
+			}
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package piglowambient
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A port that is still taken for a moment (e.g. by the previous run) is bound once it is free
+func TestListenRetrying(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := taken.Addr().String()
+	time.AfterFunc(250 * time.Millisecond, func() { taken.Close() })
+
+	listener, err := listenRetrying("tcp", address)
+	if err != nil {
+		t.Fatalf("still could not listen on %s: %v", address, err)
+	}
+	listener.Close()
+}
+
+func TestListenRetryingGivesUp(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	if listener, err := listenRetrying("tcp", taken.Addr().String()); err == nil {
+		listener.Close()
+		t.Fatal("listened on a port that stays taken")
+	}
+}
+
+// Reloading over HTTP is only for this machine, checked before anything is reloaded
+func TestReloadOnlyFromLoopback(t *testing.T) {
+	c, _ := newTestController(t, testConfig())
+	tests := []struct {
+		remote string
+		status int
+	}{
+		{"192.0.2.1:1234", http.StatusForbidden},
+		{"[2001:db8::1]:1234", http.StatusForbidden},
+		{"127.0.0.1:1234", http.StatusUnprocessableEntity}, // No configuration file to reload, but it got there
+		{"[::1]:1234", http.StatusUnprocessableEntity},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/reload", nil)
+		r.RemoteAddr = test.remote
+		w := httptest.NewRecorder()
+		c.handleReload(w, r)
+		if w.Code != test.status {
+			t.Errorf("reload from %s: got %d, expected %d", test.remote, w.Code, test.status)
+		}
+	}
+}
+
+// The reload command and POST /reload read the file again like SIGHUP, a rejected file keeps the running configuration
+// and the reply says why
+func TestReloadOnRequest(t *testing.T) {
+	c, _ := newTestController(t, testConfig())
+	path := filepath.Join(t.TempDir(), "piglow.gcfg")
+	c.SetConfigFile(path)
+	write := func(text string) {
+		if err := ioutil.WriteFile(path, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reload := func() (int, string) {
+		r := httptest.NewRequest(http.MethodPost, "/reload", nil)
+		r.RemoteAddr = "127.0.0.1:1234"
+		w := httptest.NewRecorder()
+		c.handleReload(w, r)
+		return w.Code, strings.TrimSpace(w.Body.String())
+	}
+
+	write("[Settings]\nTransitionSpeed = 1h\nLatitude = 59.91\nLongitude = 10.75\n")
+	if reply := c.Command("reload"); reply != "configuration reloaded" || c.cfg.Settings.TransitionSpeed != "1h" || c.cfg.Settings.Latitude != 59.91 {
+		t.Fatalf("got `%s`, transition speed %s at latitude %f", reply, c.cfg.Settings.TransitionSpeed, c.cfg.Settings.Latitude)
+	}
+	write("[Settings]\nTransitionSpeed = 2h\nLatitude = 59.91\nLongitude = 10.75\n")
+	if code, reply := reload(); code != http.StatusOK || reply != "configuration reloaded" || c.cfg.Settings.TransitionSpeed != "2h" {
+		t.Fatalf("got %d `%s`, transition speed %s", code, reply, c.cfg.Settings.TransitionSpeed)
+	}
+	if degraded, _, _ := c.Health(); degraded || c.configError {
+		t.Fatal("degraded after valid reloads")
+	}
+
+	// The same error as SIGHUP gets
+	write("[Settings]\nTransitionSpeed = 2h\nLatitude = 95\nLongitude = 10.75\n")
+	sighup := c.ReloadFile(path)
+	if sighup == nil {
+		t.Fatal("no error for a latitude of 95")
+	}
+	if reply := c.Command("reload"); !strings.HasPrefix(reply, "Reload failed") || !strings.Contains(reply, sighup.Error()) {
+		t.Fatalf("got `%s`, expected `%s`", reply, sighup)
+	}
+	if code, reply := reload(); code != http.StatusUnprocessableEntity || !strings.Contains(reply, sighup.Error()) {
+		t.Fatalf("got %d `%s`", code, reply)
+	}
+	if c.cfg.Settings.Latitude != 59.91 || c.cfg.Settings.TransitionSpeed != "2h" || !c.configError {
+		t.Fatalf("at latitude %f with transition speed %s, config error %v", c.cfg.Settings.Latitude, c.cfg.Settings.TransitionSpeed, c.configError)
+	}
+
+	write("[Settings]\nTransitionSpeed = fast\n")
+	if reply := c.Command("reload"); !strings.HasPrefix(reply, "Reload failed") || c.cfg.Settings.TransitionSpeed != "2h" {
+		t.Fatalf("got `%s` with transition speed %s", reply, c.cfg.Settings.TransitionSpeed)
+	}
+}
+
+// Frames written while the preview is being served, run with -race
+func TestPreviewWhileWriting(t *testing.T) {
+	cfg := testConfig()
+	cfg.Settings.PreviewImage = true
+	c, _ := newTestController(t, cfg)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for power := 0; power < 20; power++ {
+			c.writeFrame(c.renderFrame(time.Now(), power * 10))
+		}
+	}()
+	for served := 0; served < 20; served++ {
+		w := httptest.NewRecorder()
+		c.handlePreview(w, httptest.NewRequest(http.MethodGet, "/preview.png", nil))
+		if w.Code == http.StatusOK && !bytes.HasPrefix(w.Body.Bytes(), []byte("\x89PNG")) {
+			t.Fatal("served something that is not a PNG")
+		}
+	}
+	<- done
+}
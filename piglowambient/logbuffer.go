@@ -0,0 +1,82 @@
+package piglowambient
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const LOG_BUFFER_LINES = 200
+
+// Credentials in URLs (user:password@ or a token/key/password parameter) are not handed out with the logs
+var logUserinfo = regexp.MustCompile(`://[^/\s:@]+:[^/\s@]+@`)
+var logSecret = regexp.MustCompile(`((?:token|key|password|secret)=)[^&\s]+`)
+
+// The last lines of the log in memory, for getting at them without access to the log file. Log output is teed into
+// it, see log.SetOutput.
+type LogBuffer struct {
+	lock sync.Mutex
+	lines []string
+	next int
+	full bool
+	partial string
+}
+
+func NewLogBuffer(size int) *LogBuffer {
+	if size <= 0 {
+		size = LOG_BUFFER_LINES
+	}
+	return &LogBuffer{lines: make([]string, size)}
+}
+
+// Keep the lines written to the log, a line written in pieces is kept once it is complete
+func (b *LogBuffer) Write(data []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	text := b.partial + string(data)
+	lines := strings.Split(text, "\n")
+	b.partial = lines[len(lines) - 1]
+	for _, line := range lines[:len(lines) - 1] {
+		b.lines[b.next] = logSecret.ReplaceAllString(logUserinfo.ReplaceAllString(line, "://***@"), "${1}***")
+		b.next = (b.next + 1) % len(b.lines)
+		if b.next == 0 {
+			b.full = true
+		}
+	}
+	return len(data), nil
+}
+
+// Change how many lines are kept, the newest ones stay
+func (b *LogBuffer) SetSize(size int) {
+	if size <= 0 {
+		size = LOG_BUFFER_LINES
+	}
+	lines := b.Tail(size)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if size == len(b.lines) {
+		return
+	}
+	b.lines = make([]string, size)
+	copy(b.lines, lines)
+	b.next = len(lines) % size
+	b.full = len(lines) == size
+}
+
+// The last n lines, oldest first
+func (b *LogBuffer) Tail(n int) []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var lines []string
+	if b.full {
+		lines = append(lines, b.lines[b.next:]...)
+	}
+	lines = append(lines, b.lines[:b.next]...)
+	if n >= 0 && n < len(lines) {
+		lines = lines[len(lines) - n:]
+	}
+	return lines
+}
@@ -0,0 +1,150 @@
+package piglowambient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const PRESENCE_INTERVAL = 30 * time.Second
+
+// Watch the PresenceSource until it is changed, away pauses the schedule like a host that went down
+func (c *Controller) initPresence() {
+	source := strings.TrimSpace(c.cfg.Settings.PresenceSource)
+	if source == "" {
+		c.recover("presence")
+		c.setAway(false)
+		return
+	}
+
+	interval, err := getDuration(c.cfg.Settings.PresenceInterval)
+	if err != nil || interval <= 0 {
+		interval = PRESENCE_INTERVAL
+	}
+
+	generation := c.presenceGeneration
+	log.Printf("Following presence from %s", source)
+	go func() {
+		unavailable := false
+		for c.running() && generation == c.presenceGeneration {
+			away, err := readPresence(source, c.cfg.Settings.httpTimeout())
+			if err != nil {
+				// Keep going on what we saw last, the source may only be gone for a moment
+				if !unavailable {
+					log.Printf("Warning: could not read presence from %s, keeping the last state: %v", source, err)
+					unavailable = true
+				}
+				c.degrade("presence", err.Error())
+			} else {
+				if unavailable {
+					log.Printf("Presence from %s is available again", source)
+					unavailable = false
+				}
+				c.recover("presence")
+				c.setAway(away)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// Stop the running presence checks and start them again with the current configuration
+func (c *Controller) restartPresence() {
+	c.presenceGeneration++
+	c.initPresence()
+}
+
+// Whether the presence source says away, a path of a file or an http(s) URL that has home or away in it
+func readPresence(source string, timeout time.Duration) (bool, error) {
+	var data []byte
+	var err error
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		data, err = getPresence(source, timeout)
+	} else {
+		data, err = ioutil.ReadFile(source)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	switch state := strings.ToLower(strings.TrimSpace(string(data))); state {
+		case "home":
+			return false, nil
+		case "away":
+			return true, nil
+		default:
+			return false, fmt.Errorf("Presence `%s` given, has to be home or away", state)
+	}
+}
+
+func getPresence(url string, timeout time.Duration) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return nil, errors.New("unexpected status " + resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, 64))
+}
+
+// Follow the presence, a paused ping check goes first and away is only shown once it resumes
+func (c *Controller) setAway(away bool) {
+	c.pauseLock.Lock()
+	defer c.pauseLock.Unlock()
+
+	if away == c.away {
+		return
+	}
+	c.away = away
+	if away {
+		log.Printf("Nobody home, fading to %d", c.cfg.Settings.PresenceAwayPower)
+		c.sendEvent("away", "nobody home")
+	} else {
+		log.Printf("Somebody came home, resuming")
+		c.sendEvent("home", "somebody came home")
+	}
+	if c.pausedByPing {
+		return
+	}
+
+	if away {
+		if wait := c.untilMinOnTime(); wait > 0 {
+			log.Printf("The lights are on for less than the minimum on time, fading in %v unless somebody comes home", wait.Round(time.Second))
+			time.AfterFunc(wait, c.applyAway)
+			return
+		}
+		c.isPaused = true
+		c.rampTo(c.runContext(), int(c.cfg.Settings.PresenceAwayPower))
+		return
+	}
+	if !c.isPaused {
+		return // Still waiting for the minimum on time, nothing to resume
+	}
+	c.isPaused = false
+	c.rampTo(c.runContext(), c.ComputeScheduledPower(time.Now()))
+}
+
+// Pause for away once the minimum on time is over, unless somebody came home meanwhile
+func (c *Controller) applyAway() {
+	c.pauseLock.Lock()
+	defer c.pauseLock.Unlock()
+
+	if c.away && !c.pausedByPing && !c.isPaused {
+		c.isPaused = true
+		c.rampTo(c.runContext(), int(c.cfg.Settings.PresenceAwayPower))
+	}
+}
@@ -0,0 +1,45 @@
+package piglowambient
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Simulate the coming 24 hours a minute at a time and write the scheduled and written values of every LED as CSV
+func (c *Controller) WritePreview(path string, start time.Time) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := csv.NewWriter(file)
+	header := []string{"time", "power"}
+	for led := 0; led < LED_COUNT; led++ {
+		header = append(header, fmt.Sprintf("arm %d %s", led / COLOUR_COUNT, colours[led % COLOUR_COUNT]))
+	}
+	w.Write(header)
+
+	// The LEDs as they would be written, so calibrated and dark during do not disturb
+	start = start.Truncate(time.Minute)
+	for now := start; now.Before(start.Add(24 * time.Hour)); now = now.Add(time.Minute) {
+		power := c.ComputeScheduledPower(now)
+		f := outputFrame(c.renderFrame(now, power), c.doNotDisturb(now), c.render.calibration)
+
+		// The arms differ with ActiveArm, a Layout or an effect on part of them, so all LEDs
+		record := []string{now.Format("2006-01-02 15:04"), strconv.Itoa(power)}
+		for _, level := range f {
+			record = append(record, strconv.Itoa(int(level)))
+		}
+		w.Write(record)
+	}
+
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return file.Close()
+}
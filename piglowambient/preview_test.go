@@ -0,0 +1,77 @@
+package piglowambient
+
+import (
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPreviewIsWhatGetsWritten(t *testing.T) {
+	cfg := testConfig()
+	cfg.Curve.Point = []string{"00:00 200", "23:59 200"}
+	cfg.Settings.DoNotDisturb = "12:00-13:00"
+	cfg.Colors.RedMax = 100
+	c, _ := newTestController(t, cfg)
+
+	path := filepath.Join(t.TempDir(), "preview.csv")
+	start := time.Date(2025, 6, 1, 0, 0, 0, 0, time.Local)
+	if err := c.WritePreview(path, start); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 24 * 60 + 1 {
+		t.Fatalf("got %d rows, expected a header and one per minute of the day", len(records))
+	}
+
+	if header := records[0]; len(header) != 2 + LED_COUNT || header[2] != "arm 0 red" || header[len(header) - 1] != "arm 2 white" {
+		t.Fatalf("got header %v", header)
+	}
+
+	// Red of the first arm is the first column after the time and the power, white of the last arm the last
+	for _, record := range records[1:] {
+		red, white := "100", "200"
+		if record[0] >= "2025-06-01 12:00" && record[0] < "2025-06-01 13:00" {
+			red, white = "0", "0"
+		}
+		if record[2] != red || record[len(record) - 1] != white {
+			t.Fatalf("%s: red %s and white %s, expected %s and %s", record[0], record[2], record[len(record) - 1], red, white)
+		}
+	}
+}
+
+// With one arm lit the preview has that arm on and the others off
+func TestPreviewActiveArm(t *testing.T) {
+	cfg := testConfig()
+	cfg.Curve.Point = []string{"00:00 200", "23:59 200"}
+	cfg.Settings.ActiveArm = "1"
+	c, _ := newTestController(t, cfg)
+
+	path := filepath.Join(t.TempDir(), "preview.csv")
+	if err := c.WritePreview(path, time.Date(2025, 6, 1, 0, 0, 0, 0, time.Local)); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for led, level := range records[1][2:] {
+		if lit := level != "0"; lit != (led / COLOUR_COUNT == 1) {
+			t.Fatalf("%s is %s with only arm 1 active", records[0][2 + led], level)
+		}
+	}
+}
@@ -0,0 +1,652 @@
+package piglowambient
+
+import (
+	"github.com/kevinvalk/astrotime"
+	"time"
+	"math"
+	"log"
+	"strings"
+	"sync"
+)
+
+// The astrotime results can end up on the wrong side of the reference time (around ±180° longitude the event
+// may roll over the date line), so these wrappers step a day further until the event is where we expect it
+const SOLAR_EVENT_TRIES = 3
+
+// Days kept in the solar cache before it starts over, a few around today is all the schedule looks at
+const SOLAR_CACHE_DAYS = 8
+
+// A day at some coordinates, the timezone is part of it as it decides where the day starts
+type solarKey struct {
+	date string
+	location string
+	latitude float64
+	longitude float64
+}
+
+// The sunrises and sunsets astrotime gives for the start of a day, with the end of the twilights in the evening and
+// their start in the morning (missing when the sun does not get that low). Close to the midnight sun an event can
+// cross midnight, so a day has both the one that is late from yesterday and its own, found from noon.
+type solarEvents struct {
+	sunrises []time.Time
+	sunsets []time.Time
+	dusk map[string]time.Time
+	dawn map[string]time.Time
+}
+
+// The astrotime calculations behind the solar cache, variables so the tests can count the calls
+var sunriseAfter = astrotime.NextSunrise
+var sunsetAfter = astrotime.NextSunset
+
+// Solar events calculated once per day, new coordinates or a new timezone are a different key
+type solarCache struct {
+	lock sync.Mutex
+	days map[solarKey]solarEvents
+	calculations int
+}
+
+// Sunrise and sunset of the day t is on at the configured coordinates
+func (c *Controller) solarEvents(t time.Time) solarEvents {
+	return c.solarCache.events(t, c.cfg.Settings.Latitude, c.cfg.Settings.Longitude)
+}
+
+// Sunrise and sunset of the day t is on, calculated the first time the day is asked for
+func (cache *solarCache) events(t time.Time, latitude float64, longitude float64) solarEvents {
+	t = t.Local()
+	year, month, day := t.Date()
+	midnight := time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+	key := solarKey{date: midnight.Format("2006-01-02"), location: t.Location().String(), latitude: latitude, longitude: longitude}
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if events, ok := cache.days[key]; ok {
+		return events
+	}
+	if cache.days == nil || len(cache.days) >= SOLAR_CACHE_DAYS {
+		cache.days = make(map[solarKey]solarEvents)
+	}
+	noon := midnight.Add(12 * time.Hour)
+	events := solarEvents{sunrises: solarPair(sunriseAfter(midnight, latitude, longitude), sunriseAfter(noon, latitude, longitude)),
+		sunsets: solarPair(sunsetAfter(midnight, latitude, longitude), sunsetAfter(noon, latitude, longitude))}
+	events.dusk = make(map[string]time.Time)
+	events.dawn = make(map[string]time.Time)
+	for name, angle := range twilightAngles {
+		if dusk, ok := sunBelowHorizon(midnight, latitude, longitude, angle, false); ok {
+			events.dusk[name] = dusk
+		}
+		if dawn, ok := sunBelowHorizon(midnight, latitude, longitude, angle, true); ok {
+			events.dawn[name] = dawn
+		}
+	}
+	cache.days[key] = events
+	cache.calculations++
+	return events
+}
+
+// The events found from midnight and from noon, only once when it is the same one
+func solarPair(fromMidnight time.Time, fromNoon time.Time) []time.Time {
+	if fromNoon.Equal(fromMidnight) {
+		return []time.Time{fromMidnight}
+	}
+	return []time.Time{fromMidnight, fromNoon}
+}
+
+// First sunrise after t
+func (c *Controller) nextSunrise(t time.Time) time.Time {
+	return c.firstSolarEvent(t, func(events solarEvents) []time.Time { return events.sunrises })
+}
+
+// First sunset after t
+func (c *Controller) nextSunset(t time.Time) time.Time {
+	return c.firstSolarEvent(t, func(events solarEvents) []time.Time { return events.sunsets })
+}
+
+// First of the sunrises or sunsets of the day of t and the days after that is after t
+func (c *Controller) firstSolarEvent(t time.Time, of func(solarEvents) []time.Time) time.Time {
+	return c.solarCache.firstEvent(t, c.cfg.Settings.Latitude, c.cfg.Settings.Longitude, of)
+}
+
+// First of the sunrises or sunsets at some coordinates after t
+func (cache *solarCache) firstEvent(t time.Time, latitude float64, longitude float64, of func(solarEvents) []time.Time) time.Time {
+	var event time.Time
+	for i := 0; i <= SOLAR_EVENT_TRIES; i++ {
+		for _, event = range of(cache.events(t.AddDate(0, 0, i), latitude, longitude)) {
+			if event.After(t) {
+				return event
+			}
+		}
+	}
+	return event
+}
+
+// Last sunset before t
+func (c *Controller) previousSunset(t time.Time) time.Time {
+	var sunset time.Time
+	for i := 0; i <= SOLAR_EVENT_TRIES; i++ {
+		sunsets := c.solarEvents(t.AddDate(0, 0, -i)).sunsets
+		for j := len(sunsets) - 1; j >= 0; j-- {
+			if sunset = sunsets[j]; sunset.Before(t) {
+				return sunset
+			}
+		}
+	}
+	return sunset
+}
+
+// Calculate the transition and the next fade times from the configuration
+func (c *Controller) initSchedule() {
+	c.transitionTime, _ = getTransitionSpeed(c.cfg.Settings.TransitionSpeed) // Already validated
+	c.transitionDuration = time.Duration(c.transitionTime) * time.Second
+	c.sleepDuration = time.Duration((float64(c.transitionTime)/float64(MAX_POWER)*0.9) * 1000000000)  // Dynamic calculate sleep time to optimize CPU usage while maintaining smooth transitions when the transition period is very small
+	if c.sleepDuration > time.Second || c.sleepDuration <= 0 {
+		c.sleepDuration = time.Second // Also for a zero transition, switching instantly does not need a fast loop
+	}
+
+	// A configured update interval replaces the heuristic
+	if updateInterval, _ := getDuration(c.cfg.Settings.UpdateInterval); updateInterval > 0 {
+		c.sleepDuration = updateInterval
+		if updateInterval < MIN_UPDATE_INTERVAL {
+			log.Printf("Warning: an update interval of %v will keep the CPU busy", updateInterval)
+		}
+	}
+
+	// Calculate sunset/sunrise, I am using this so that no matter when you start this program it will always have to correct sunrise/sunset
+	sunrise := c.nextSunrise(time.Now())
+	sunset := c.previousSunset(sunrise)
+
+	// Calculate the fade times
+	c.fadeOutTime = c.clampSunrise(sunrise).Add(c.fadeOffset())
+	c.fadeInTime = c.clampSunset(sunset).Add(c.fadeOffset())
+
+	c.curve, _ = parseCurve(c.cfg.Curve.Point) // Already validated
+	c.displayZone, _ = getDisplayTimezone(c.cfg.Settings.DisplayTimezone)
+	c.lateNightDim, _ = parseLateNightDim(c.cfg.Settings.LateNightDim)
+
+	// The noon accent has to follow new coordinates as well
+	c.accentNoon = time.Time{}
+	c.solar = solarDay{}
+}
+
+// Parse the settings the render path needs for every frame once, at startup and on every reload
+func (c *Controller) initRender() {
+	// All already validated
+	c.render.layout, _ = parseLayout(c.cfg.Layout.Order)
+	c.render.calibration = c.cfg.Colors.calibration()
+	c.render.balance, _ = getWhiteBalance(c.cfg.Settings.WhiteBalance)
+	c.render.arm, _ = getActiveArm(c.cfg.Settings.ActiveArm)
+	c.render.pilot, _ = getPilotLeds(c.cfg.Settings.PilotLED)
+	c.render.dndStart, c.render.dndEnd, c.render.dnd, _ = getDoNotDisturb(c.cfg.Settings.DoNotDisturb)
+	c.render.twilightBalance = make(map[string][COLOUR_COUNT]int)
+	for name, twilight := range c.cfg.Twilight {
+		if twilight.Balance != "" {
+			balance, _ := getWhiteBalance(twilight.Balance)
+			c.render.twilightBalance[name] = balance
+		}
+	}
+}
+
+// Sunrise, sunset, solar noon and the length of the day today, calculated once a day
+func (c *Controller) solarToday(now time.Time) solarDay {
+	year, month, day := now.Date()
+	midnight := time.Date(year, month, day, 0, 0, 0, 0, now.Location())
+	if !c.solar.date.Equal(midnight) {
+		sunrise := c.nextSunrise(midnight)
+		sunset := c.nextSunset(sunrise)
+		c.solar = solarDay{date: midnight, sunrise: sunrise, sunset: sunset, noon: sunrise.Add(sunset.Sub(sunrise) / 2), length: sunset.Sub(sunrise)}
+	}
+	return c.solar
+}
+
+// Start of the first fade in after t
+func (c *Controller) nextFadeIn(t time.Time) time.Time {
+	minDay, minNight := c.minDayNight()
+	sunset := c.nextSunset(t.Add(-(minDay + minNight)/2))
+	for i := 0; i < SOLAR_EVENT_TRIES && !c.clampSunset(sunset).Add(c.fadeOffset()).After(t); i++ {
+		sunset = c.nextSunset(sunset.Add(time.Minute))
+	}
+	return c.clampSunset(sunset).Add(c.fadeOffset())
+}
+
+// Start of the first fade out after t
+func (c *Controller) nextFadeOut(t time.Time) time.Time {
+	minDay, minNight := c.minDayNight()
+	sunrise := c.nextSunrise(t.Add(-(minDay + minNight)/2))
+	for i := 0; i < SOLAR_EVENT_TRIES && !c.clampSunrise(sunrise).Add(c.fadeOffset()).After(t); i++ {
+		sunrise = c.nextSunrise(sunrise.Add(time.Minute))
+	}
+	return c.clampSunrise(sunrise).Add(c.fadeOffset())
+}
+
+// Shortest day and night that still leave MinOffWindow/MinOnWindow between the fades, zero when not configured
+func (c *Controller) minDayNight() (time.Duration, time.Duration) {
+	minOff, _ := getDuration(c.cfg.Settings.MinOffWindow) // Already validated
+	minOn, _ := getDuration(c.cfg.Settings.MinOnWindow)
+	var minDay, minNight time.Duration
+	if minOff > 0 {
+		minDay = minOff + c.transitionDuration
+	}
+	if minOn > 0 {
+		minNight = minOn + c.transitionDuration
+	}
+	return minDay, minNight
+}
+
+// Whether the fade out runs into the fade in and the fade in into the fade out on every day of the coming year, the
+// lights would never settle on or off
+func fadesAlwaysOverlap(conf *Config, transition time.Duration) bool {
+	events := strings.ToLower(conf.Settings.Events)
+	if !conf.Settings.FadeIn || !conf.Settings.FadeOut || (events != "" && events != "both") {
+		return false
+	}
+	if len(conf.Curve.Point) > 0 || len(conf.Twilight) > 0 || checkCoordinates(conf.Settings.Latitude, conf.Settings.Longitude) != nil {
+		return false
+	}
+
+	// There is no controller yet, a cache of its own still calculates every day only once
+	var cache solarCache
+	sunrises := func(events solarEvents) []time.Time { return events.sunrises }
+	sunsets := func(events solarEvents) []time.Time { return events.sunsets }
+	latitude, longitude := conf.Settings.Latitude, conf.Settings.Longitude
+	year, month, day := time.Now().Date()
+	for i := 0; i < 366; i++ {
+		midnight := time.Date(year, month, day + i, 0, 0, 0, 0, time.Local)
+		sunrise := cache.firstEvent(midnight, latitude, longitude, sunrises)
+		sunset := cache.firstEvent(sunrise, latitude, longitude, sunsets)
+		if sunset.Sub(sunrise) >= transition || cache.firstEvent(sunset, latitude, longitude, sunrises).Sub(sunset) >= transition {
+			return false
+		}
+	}
+	return true
+}
+
+// Sunrise the fades use, a day or night that is too short for the minimum windows is stretched around solar noon or
+// midnight
+func (c *Controller) clampSunrise(sunrise time.Time) time.Time {
+	minDay, minNight := c.minDayNight()
+	if minDay == 0 && minNight == 0 {
+		return sunrise
+	}
+	shift := time.Duration(0)
+	if day := c.nextSunset(sunrise).Sub(sunrise); day < minDay {
+		shift -= (minDay - day) / 2
+	}
+	if night := sunrise.Sub(c.previousSunset(sunrise)); night < minNight {
+		shift += (minNight - night) / 2
+	}
+	return sunrise.Add(shift)
+}
+
+// Sunset the fades use, see clampSunrise
+func (c *Controller) clampSunset(sunset time.Time) time.Time {
+	minDay, minNight := c.minDayNight()
+	if minDay == 0 && minNight == 0 {
+		return sunset
+	}
+	shift := time.Duration(0)
+	if day := sunset.Sub(c.nextSunrise(sunset.Add(-24 * time.Hour))); day < minDay {
+		shift += (minDay - day) / 2
+	}
+	if night := c.nextSunrise(sunset).Sub(sunset); night < minNight {
+		shift -= (minNight - night) / 2
+	}
+	return sunset.Add(shift)
+}
+
+// Whether the lights are used this time of the year
+func (c *Controller) inSeason(now time.Time) bool {
+	from, to, _ := getActiveMonths(c.cfg.Settings.ActiveMonths) // Already validated
+	return monthActive(now.Month(), from, to)
+}
+
+// Where a fade starts relative to sunset/sunrise, by default it is centered on the event
+func (c *Controller) fadeOffset() time.Duration {
+	switch strings.ToLower(c.cfg.Settings.FadeAlignment) {
+		case "before":
+			return -c.transitionDuration
+		case "after":
+			return 0
+	}
+	return -c.transitionDuration/2
+}
+
+// Time until the next fade starts, zero when neither is ahead
+func (c *Controller) untilNextFade(now time.Time) time.Duration {
+	var until time.Duration
+	for _, start := range []time.Time{c.fadeInTime, c.fadeOutTime} {
+		if wait := start.Sub(now); wait > 0 && (until == 0 || wait < until) {
+			until = wait
+		}
+	}
+	return until
+}
+
+// Time until a running fade gets to the next brightness, zero when no fade is running (or it does not go in steps)
+func (c *Controller) untilPowerChange(now time.Time) time.Duration {
+	if len(c.curve) > 0 || len(c.cfg.Twilight) > 0 {
+		return 0
+	}
+	fades := []struct{ start time.Time; seconds int }{{c.fadeInTime, c.fadeInSeconds()}, {c.fadeOutTime, c.fadeOutSeconds()}}
+	for _, fade := range fades {
+		elapsed := now.Sub(fade.start)
+		if fade.seconds <= 0 || elapsed <= 0 || elapsed >= time.Duration(fade.seconds) * time.Second {
+			continue
+		}
+
+		// The brightness is rounded, so it steps when the exact level gets halfway to the next one
+		level := MAX_POWER * elapsed.Seconds() / float64(fade.seconds)
+		step := (math.Floor(level + 0.5) + 0.5) * float64(fade.seconds) / MAX_POWER
+		return time.Duration(step * float64(time.Second)) - elapsed + time.Millisecond
+	}
+	return 0
+}
+
+// A time for the log lines, always in the DisplayTimezone and with its abbreviation so a UTC time cannot pass as local
+func (c *Controller) logTime(t time.Time) string {
+	return c.displayTime(t).Format("15:04:05 MST on 1/2/2006")
+}
+
+func (c *Controller) logClock(t time.Time) string {
+	return c.displayTime(t).Format(LOG_CLOCK_FORMAT)
+}
+
+// A time in the DisplayTimezone, the local timezone without one
+func (c *Controller) displayTime(t time.Time) time.Time {
+	if c.displayZone == nil {
+		return t.In(time.Local)
+	}
+	return t.In(c.displayZone)
+}
+
+// Announce the schedule
+func (c *Controller) logSchedule() {
+	log.Printf("Transition time in seconds: %d, Sleep duration: %.04f", c.transitionTime, c.sleepDuration.Seconds())
+	log.Printf("Latitude: %f, Longitude: %f", c.cfg.Settings.Latitude, c.cfg.Settings.Longitude)
+	solar := c.solarToday(time.Now())
+	log.Printf("Today sunrise is %s, solar noon %s, sunset %s, the day is %v long", c.logClock(solar.sunrise), c.logClock(solar.noon), c.logClock(solar.sunset), solar.length.Round(time.Minute))
+	log.Printf("The next fadeIn  is %s", c.logTime(c.fadeInTime))
+	log.Printf("The next fadeOut is %s", c.logTime(c.fadeOutTime))
+}
+
+// Length of the fade in, zero when it is disabled so the lights switch on at the trigger
+func (c *Controller) fadeInSeconds() int {
+	if !c.cfg.Settings.FadeIn {
+		return 0
+	}
+	return c.transitionTime
+}
+
+// Length of the fade out, zero when it is disabled so the lights switch off at the trigger
+func (c *Controller) fadeOutSeconds() int {
+	if !c.cfg.Settings.FadeOut {
+		return 0
+	}
+	return c.transitionTime
+}
+
+// Calculate the brightness the schedule dictates at the given moment
+func (c *Controller) ComputeScheduledPower(now time.Time) int {
+	if !c.inSeason(now) {
+		return 0
+	}
+	if len(c.curve) > 0 {
+		return curvePower(c.curve, now)
+	}
+	if len(c.cfg.Twilight) > 0 {
+		power, _, _, _ := c.twilightTarget(now)
+		return power
+	}
+
+	// Look for the sunrise a transition back so a fade out that is still in progress is found as well
+	minDay, minNight := c.minDayNight()
+	sunrise := c.nextSunrise(now.Add(-c.transitionDuration - c.fadeOffset() - (minDay + minNight)/2))
+	for i := 0; i < SOLAR_EVENT_TRIES && !now.Before(c.clampSunrise(sunrise).Add(c.fadeOffset() + c.transitionDuration)); i++ {
+		sunrise = c.nextSunrise(sunrise.Add(time.Minute)) // Moved by the minimum windows, its fade out is already over
+	}
+	sunset := c.previousSunset(sunrise)
+
+	fadeInTime := c.clampSunset(sunset).Add(c.fadeOffset())
+	fadeOutTime := c.clampSunrise(sunrise).Add(c.fadeOffset())
+
+	// Daytime, before the fade in has started
+	if now.Before(fadeInTime) {
+		return 0
+	}
+
+	// Only fading out lights that someone else switched on, on its own the lights stay off
+	if c.events() == "sunrise" {
+		return 0
+	}
+
+	// Evening, fading in or fully on
+	if now.Before(fadeOutTime) {
+		return c.fadeInPower(now.Sub(fadeInTime))
+	}
+
+	// Morning, fading out unless the lights stay on until switched off by hand
+	if c.events() == "sunset" {
+		return c.holdPower()
+	}
+	return c.fadeOutPower(now.Sub(fadeOutTime))
+}
+
+// Whether the fade in overshoots before settling on the hold brightness
+func (c *Controller) overshoot() bool {
+	return strings.ToLower(c.cfg.Settings.FadeInEasing) == "overshoot"
+}
+
+// Brightness the lights stay at after the fade in
+func (c *Controller) holdPower() int {
+	if c.overshoot() {
+		return MAX_POWER - int(c.cfg.Settings.OvershootPeak)
+	}
+	return MAX_POWER
+}
+
+// How long the overshoot takes to settle after the rise of the fade in, zero without it
+func (c *Controller) overshootSettle() time.Duration {
+	if !c.overshoot() {
+		return 0
+	}
+	settle, _ := getDuration(c.cfg.Settings.OvershootSettle) // Already validated
+	return settle
+}
+
+// Exact brightness during a fade in, with the easing applied
+func (c *Controller) fadeInCurve(elapsed time.Duration) float64 {
+	level := fadeInLevel(elapsed, c.fadeInSeconds())
+	if !c.overshoot() {
+		return level
+	}
+	return overshootLevel(level, elapsed - time.Duration(c.fadeInSeconds()) * time.Second, c.overshootSettle(), int(c.cfg.Settings.OvershootPeak))
+}
+
+// Brightness after the given time into the fade in
+func (c *Controller) fadeInPower(elapsed time.Duration) int {
+	return int(math.Round(c.fadeInCurve(elapsed)))
+}
+
+// Whether the fade in is over, with the overshoot only once it settled
+func (c *Controller) fadeInComplete(elapsed time.Duration, power int) bool {
+	if !c.overshoot() {
+		return power >= MAX_POWER
+	}
+	return elapsed >= time.Duration(c.fadeInSeconds()) * time.Second + c.overshootSettle()
+}
+
+// Brightness after the given time into the fade out, it starts going down once it passes the hold brightness
+func (c *Controller) fadeOutPower(elapsed time.Duration) int {
+	power := computeFadeOutPower(elapsed, c.fadeOutSeconds())
+	if hold := c.holdPower(); power > hold {
+		return hold
+	}
+	return power
+}
+
+// Which of the fades run: both, sunset (only the fade in) or sunrise (only the fade out)
+func (c *Controller) events() string {
+	events := strings.ToLower(c.cfg.Settings.Events)
+	if events == "" {
+		return "both"
+	}
+	return events
+}
+
+// Everything the LEDs show for a scheduled brightness at the given moment
+func (c *Controller) renderFrame(now time.Time, power int) frame {
+	// Dark because the host is down, show that instead of nothing
+	if c.pausedByPing && power == 0 && c.cfg.Settings.DownColour != "" && !c.cfg.Settings.PauseOnUp {
+		var f frame
+		f.setColour(strings.ToLower(c.cfg.Settings.DownColour), uint8(c.cfg.Settings.DownColourPower)) // Already validated
+		return f
+	}
+
+	var f frame
+	if c.holdEffect(now) {
+		f = chaseFrame(now, c.applyOverlays(now, power))
+	} else {
+		f = uniformFrame(c.applyOverlays(now, power))
+	}
+	balance := c.render.balance
+	if len(c.cfg.Twilight) > 0 {
+		_, balance, _, _ = c.twilightTarget(now)
+	}
+	f.balance(balance)
+	if boost := c.blueHour(now); boost > 0 {
+		// Warm colours go down as well, otherwise a boost on full brightness would not show
+		for ring := range colours {
+			if ring >= 4 {
+				f.boostRing(ring, boost) // Blue and white
+			} else {
+				f.boostRing(ring, -boost)
+			}
+		}
+	}
+	if c.render.arm >= 0 {
+		f.onlyArm(c.render.arm)
+	}
+
+	// The pilot light stays on under everything but an override
+	if c.currentOverride() == "" {
+		for _, led := range c.render.pilot {
+			if f[led] < uint8(c.cfg.Settings.PilotBrightness) {
+				f[led] = uint8(c.cfg.Settings.PilotBrightness)
+			}
+		}
+	}
+	return f
+}
+
+// Whether the lights are forced off by the DoNotDisturb window, unless lifted with the dnd command
+func (c *Controller) doNotDisturb(now time.Time) bool {
+	start, end := c.render.dndStart, c.render.dndEnd
+	if !c.render.dnd || now.Before(c.dndLiftedUntil) {
+		return false
+	}
+	second := now.Hour() * 3600 + now.Minute() * 60 + now.Second()
+	if start < end {
+		return second >= start && second < end
+	}
+	return second >= start || second < end // Over midnight
+}
+
+// Time until the do not disturb window starts or ends, zero without one
+func (c *Controller) untilDoNotDisturbChange(now time.Time) time.Duration {
+	if !c.render.dnd {
+		return 0
+	}
+	return time.Duration(math.Min(float64(untilClock(now, c.render.dndStart)), float64(untilClock(now, c.render.dndEnd))))
+}
+
+// Time until the clock is at the second since midnight, a whole day when it is right now
+func untilClock(now time.Time, second int) time.Duration {
+	current := now.Hour() * 3600 + now.Minute() * 60 + now.Second()
+	until := (second - current + 24 * 3600) % (24 * 3600)
+	if until == 0 {
+		until = 24 * 3600
+	}
+	return time.Duration(until) * time.Second - time.Duration(now.Nanosecond())
+}
+
+// Emphasis of the cool colours right after the fade in, decaying to nothing over the blue hour (when enabled)
+func (c *Controller) blueHour(now time.Time) int {
+	if c.cfg.Settings.BlueHour <= 0 || c.isPaused || c.currentOverride() != "" {
+		return 0
+	}
+
+	duration, err := getDuration(c.cfg.Settings.BlueHourDuration)
+	if err != nil || duration <= 0 {
+		duration = 30 * time.Minute
+	}
+
+	// Starts when the fade in of the last sunset is complete
+	start := c.clampSunset(c.previousSunset(now)).Add(c.fadeOffset() + time.Duration(c.fadeInSeconds()) * time.Second)
+	elapsed := now.Sub(start)
+	if elapsed < 0 || elapsed > duration {
+		return 0
+	}
+	return int(math.Round(float64(c.cfg.Settings.BlueHour) * (1 - elapsed.Seconds() / duration.Seconds())))
+}
+
+// Whether the hold effect runs, only while the lights are on between the fades
+func (c *Controller) holdEffect(now time.Time) bool {
+	return strings.ToLower(c.cfg.Settings.HoldEffect) == "chase" && !c.isPaused && c.currentOverride() == "" && c.phase(now) == "night"
+}
+
+// A brighter spot slowly walking around the arms, the arms are a third of a turn apart so on average they stay at
+// the given brightness (except where that would go over the maximum)
+func chaseFrame(now time.Time, power int) frame {
+	var f frame
+	turn := float64(now.UnixNano() % int64(CHASE_PERIOD)) / float64(CHASE_PERIOD)
+	for led := range f {
+		arm := led / COLOUR_COUNT
+		level := float64(power) * (1 + CHASE_DEPTH * math.Cos(2 * math.Pi * (turn - float64(arm) / ARM_COUNT)))
+		f[led] = uint8(math.Max(0, math.Min(MAX_POWER, math.Round(level))))
+	}
+	return f
+}
+
+// Add the effects that go on top of the scheduled brightness (not while paused), with a maximum of 255
+func (c *Controller) applyOverlays(now time.Time, power int) int {
+	if c.isPaused {
+		return power
+	}
+
+	power += c.noonAccent(now)
+	if power > MAX_POWER {
+		power = MAX_POWER
+	}
+
+	// Nothing else takes over the LEDs, a test pattern or preview should show everything
+	if c.currentOverride() == "" {
+		if ceiling := int(math.Round(float64(c.holdPower()) * lateNightPercentage(c.lateNightDim, now) / 100)); power > ceiling {
+			power = ceiling
+		}
+	}
+	return power
+}
+
+// Brightness of the gentle pulse around solar noon, zero outside of it or when disabled
+func (c *Controller) noonAccent(now time.Time) int {
+	if c.cfg.Settings.NoonAccent <= 0 {
+		return 0
+	}
+
+	duration, err := getDuration(c.cfg.Settings.NoonAccentDuration)
+	if err != nil || duration <= 0 {
+		duration = 10 * time.Minute
+	}
+
+	// Solar noon is the midpoint between sunrise and the following sunset, only calculated once a day
+	if c.accentNoon.IsZero() || now.Sub(c.accentNoon) > 12 * time.Hour {
+		sunrise := c.nextSunrise(now.Add(-12 * time.Hour))
+		sunset := c.nextSunset(sunrise)
+		c.accentNoon = sunrise.Add(sunset.Sub(sunrise) / 2)
+	}
+
+	// Raised cosine so the pulse starts and ends smoothly
+	offset := now.Sub(c.accentNoon)
+	if offset < -duration/2 || offset > duration/2 {
+		return 0
+	}
+	return int(math.Round(float64(c.cfg.Settings.NoonAccent) * (1 + math.Cos(2 * math.Pi * offset.Seconds() / duration.Seconds())) / 2))
+}
@@ -0,0 +1,647 @@
+package piglowambient
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// At the end of the midnight sun in Tromsø the sunset goes back over midnight, the 29th of July has the late one of
+// the 28th and its own
+func TestTwoSunsetsInADay(t *testing.T) {
+	c, _, start := replayController(t, "Europe/Oslo", 69.65, 18.96)
+	morning := time.Date(2025, 7, 29, 6, 0, 0, 0, start.Location())
+	sunset := c.nextSunset(morning)
+	if sunset.Day() != 29 || sunset.Hour() != 23 {
+		t.Fatalf("next sunset after %s is %s, expected the one late that evening", morning, sunset)
+	}
+	if previous := c.previousSunset(sunset.Add(time.Hour)); !previous.Equal(sunset) {
+		t.Fatalf("previous sunset is %s, expected %s", previous, sunset)
+	}
+	if previous := c.previousSunset(morning); previous.Day() != 29 || previous.Hour() != 0 {
+		t.Fatalf("previous sunset before %s is %s, expected the one just after midnight", morning, previous)
+	}
+}
+
+// Places from the equator to beyond the polar circle, on both sides of the date line and of the equator
+var replayPlaces = []struct {
+	name string
+	zone string
+	latitude, longitude float64
+}{
+	{"Amsterdam", "Europe/Amsterdam", 52.37, 4.90},
+	{"Oslo", "Europe/Oslo", 59.91, 10.75},
+	{"Tromsø", "Europe/Oslo", 69.65, 18.96},
+	{"Quito", "America/Guayaquil", -0.18, -78.47},
+	{"Sydney", "Australia/Sydney", -33.87, 151.21},
+	{"Auckland", "Pacific/Auckland", -36.85, 174.76},
+	{"Honolulu", "Pacific/Honolulu", 21.31, -157.86},
+}
+
+// Around the date line (where the local day and the UTC day are furthest apart) and just below the polar circles the
+// next sunrise is always ahead and the previous sunset always behind, and never more than a day and a bit away
+func TestSolarEventsAroundTheDateLine(t *testing.T) {
+	places := []struct {
+		name string
+		zone string
+		latitude, longitude float64
+	}{
+		{"Fiji", "Pacific/Fiji", -18.14, 178.44},
+		{"Tonga", "Pacific/Tongatapu", -21.14, -175.2},
+		{"Kiritimati", "Pacific/Kiritimati", 1.87, -157.43},
+		{"Chatham", "Pacific/Chatham", -43.95, -176.56},
+		{"Anadyr", "Asia/Anadyr", 64.73, 177.5},
+		{"Fairbanks", "America/Anchorage", 64.84, -147.72},
+	}
+	for _, place := range places {
+		t.Run(place.name, func(t *testing.T) {
+			c, _, start := replayController(t, place.zone, place.latitude, place.longitude)
+			for now := start; now.Before(start.AddDate(1, 0, 0)); now = now.Add(5 * time.Hour) {
+				if sunrise := c.nextSunrise(now); !sunrise.After(now) || sunrise.Sub(now) > 30 * time.Hour {
+					t.Fatalf("%s: next sunrise %s", now, sunrise)
+				}
+				if sunset := c.previousSunset(now); !sunset.Before(now) || now.Sub(sunset) > 30 * time.Hour {
+					t.Fatalf("%s: previous sunset %s", now, sunset)
+				}
+			}
+		})
+	}
+}
+
+// Controller for a place, with the clock of the Pi set to the time zone there like it would be
+func replayController(t *testing.T, zone string, latitude float64, longitude float64) (*Controller, *recordingGlow, time.Time) {
+	t.Helper()
+	location, err := time.LoadLocation(zone)
+	if err != nil {
+		t.Skipf("no time zone %s: %v", zone, err)
+	}
+	local := time.Local
+	time.Local = location
+	t.Cleanup(func() { time.Local = local })
+
+	cfg := testConfig()
+	cfg.Settings.Latitude = latitude
+	cfg.Settings.Longitude = longitude
+	c, glow := newTestController(t, cfg)
+	return c, glow, time.Date(2025, 1, 1, 0, 0, 0, 0, location)
+}
+
+// Step through a whole year of every place (over the solstices, the DST changes and the polar days and nights), the
+// brightness has to stay in range and be what gets written
+func TestReplayYear(t *testing.T) {
+	for _, place := range replayPlaces {
+		t.Run(place.name, func(t *testing.T) {
+			c, glow, start := replayController(t, place.zone, place.latitude, place.longitude)
+			for now := start; now.Before(start.AddDate(1, 0, 0)); now = now.Add(10 * time.Minute) {
+				power := c.ComputeScheduledPower(now)
+				if power < 0 || power > MAX_POWER {
+					t.Fatalf("%s: brightness %d", now, power)
+				}
+				if toFadeIn, toFadeOut := c.nextFadeIn(now).Sub(now), c.nextFadeOut(now).Sub(now); toFadeIn <= 0 || toFadeOut <= 0 {
+					t.Fatalf("%s: next fade in after %v, fade out after %v", now, toFadeIn, toFadeOut)
+				}
+
+				c.writeFrame(c.renderFrame(now, power))
+				written := glow.last()
+				lit := false
+				for _, level := range written {
+					lit = lit || level > 0
+				}
+				if lit != (power > 0) {
+					t.Fatalf("%s: brightness %d, but wrote %v", now, power, written)
+				}
+			}
+		})
+	}
+}
+
+// Every fade of the year goes the one way only and ends where it should
+func TestReplayYearFades(t *testing.T) {
+	for _, place := range replayPlaces {
+		t.Run(place.name, func(t *testing.T) {
+			c, _, start := replayController(t, place.zone, place.latitude, place.longitude)
+			end := start.AddDate(1, 0, 0)
+			fades := 0
+			for fadeIn := c.nextFadeIn(start); fadeIn.Before(end); fadeIn = later(fadeIn, c.nextFadeIn(fadeIn.Add(time.Minute))) {
+				checkFade(t, c, fadeIn, c.nextFadeOut(fadeIn.Add(-c.transitionDuration)), c.nextFadeOut(fadeIn), 1)
+				fades++
+			}
+			for fadeOut := c.nextFadeOut(start); fadeOut.Before(end); fadeOut = later(fadeOut, c.nextFadeOut(fadeOut.Add(time.Minute))) {
+				checkFade(t, c, fadeOut, c.nextFadeIn(fadeOut.Add(-c.transitionDuration)), c.nextFadeIn(fadeOut), -1)
+				fades++
+			}
+			if fades == 0 {
+				t.Fatal("no fades in a whole year")
+			}
+		})
+	}
+}
+
+// Check a fade from start onwards goes in direction (1 up, -1 down) every minute, and once it is done before the
+// next fade begins the lights are fully on or off. The other fade is the one that starts a transition before at the
+// earliest, and next the one after.
+func checkFade(t *testing.T, c *Controller, start time.Time, other time.Time, next time.Time, direction int) {
+	t.Helper()
+	if other.Before(start) {
+		return // Days (or nights) shorter than the transition, the fade that is still going wins
+	}
+	previous := c.ComputeScheduledPower(start)
+	for elapsed := time.Minute; elapsed <= c.transitionDuration; elapsed += time.Minute {
+		now := start.Add(elapsed)
+		if !now.Before(next) {
+			return // Cut short by the next fade
+		}
+		power := c.ComputeScheduledPower(now)
+		if (power - previous) * direction < 0 {
+			t.Fatalf("fade at %s went from %d to %d after %v", start, previous, power, elapsed)
+		}
+		previous = power
+	}
+
+	// Going into a polar day or night the next fade is weeks away, what the lights settle on there depends on how
+	// astrotime rounds the last sunrise or sunset
+	if done := start.Add(c.transitionDuration + time.Minute); done.Before(next) && next.Sub(start) < 24 * time.Hour {
+		expected := 0
+		if direction > 0 {
+			expected = c.holdPower()
+		}
+		if power := c.ComputeScheduledPower(done); power != expected {
+			t.Fatalf("fade at %s ended at %d, expected %d", start, power, expected)
+		}
+	}
+}
+
+// Without a transition the lights switch once in the morning and once in the evening, straight between off and full
+func TestInstantTransition(t *testing.T) {
+	c, glow, start := replayController(t, "Europe/Amsterdam", 52.37, 4.90)
+	newCfg := c.cfg
+	newCfg.Settings.TransitionSpeed = "0"
+	if err := c.Reload(newCfg); err != nil {
+		t.Fatal(err)
+	}
+	c.initSchedule()
+
+	for day := 0; day < 365; day += 30 {
+		changes := 0
+		previous := -1
+		midnight := start.AddDate(0, 0, day)
+		for now := midnight; now.Before(midnight.AddDate(0, 0, 1)); now = now.Add(time.Minute) {
+			power := c.ComputeScheduledPower(now)
+			if power != 0 && power != MAX_POWER {
+				t.Fatalf("%s: brightness %d without a transition", now, power)
+			}
+			if previous >= 0 && power != previous {
+				changes++
+			}
+			previous = power
+		}
+		if changes != 2 {
+			t.Errorf("%s: %d changes in a day", midnight.Format("2006-01-02"), changes)
+		}
+	}
+
+	// And those are the only writes to the PiGlow
+	written := len(glow.written())
+	for now := start; now.Before(start.AddDate(0, 0, 1)); now = now.Add(time.Minute) {
+		c.writeFrame(c.renderFrame(now, c.ComputeScheduledPower(now)))
+	}
+	if writes := len(glow.written()) - written; writes != 3 {
+		t.Errorf("%d writes in a day, expected the lights on at midnight and two changes", writes)
+	}
+}
+
+// Without a fade in the lights snap on at the trigger and still fade out in the morning, and the other way around
+func TestOneDirectionInstant(t *testing.T) {
+	tests := []struct {
+		fadeIn, fadeOut bool
+	}{
+		{false, true},
+		{true, false},
+	}
+	for _, test := range tests {
+		c, _, start := replayController(t, "Europe/Amsterdam", 52.37, 4.90)
+		c.cfg.Settings.FadeIn = test.fadeIn
+		c.cfg.Settings.FadeOut = test.fadeOut
+		noon := start.AddDate(0, 2, 19).Add(12 * time.Hour)
+
+		fadeIn := c.nextFadeIn(noon)
+		halfway := fadeIn.Add(c.transitionDuration / 2)
+		if before := c.ComputeScheduledPower(fadeIn.Add(-time.Minute)); before != 0 {
+			t.Errorf("fade in %v: %d before the fade in", test.fadeIn, before)
+		}
+		if power := c.ComputeScheduledPower(halfway); test.fadeIn != (power < MAX_POWER) || power == 0 {
+			t.Errorf("fade in %v: %d halfway the fade in", test.fadeIn, power)
+		}
+
+		fadeOut := c.nextFadeOut(fadeIn)
+		halfway = fadeOut.Add(c.transitionDuration / 2)
+		if before := c.ComputeScheduledPower(fadeOut.Add(-time.Minute)); before != MAX_POWER {
+			t.Errorf("fade out %v: %d before the fade out", test.fadeOut, before)
+		}
+		if power := c.ComputeScheduledPower(halfway); test.fadeOut != (power > 0) || power == MAX_POWER {
+			t.Errorf("fade out %v: %d halfway the fade out", test.fadeOut, power)
+		}
+
+		// The main loop goes the same way
+		if power := c.fadeInPower(time.Second); test.fadeIn != (power < MAX_POWER) {
+			t.Errorf("fade in %v: main loop at %d a second in", test.fadeIn, power)
+		}
+		if power := c.fadeOutPower(time.Second); test.fadeOut != (power > 0) {
+			t.Errorf("fade out %v: main loop at %d a second in", test.fadeOut, power)
+		}
+	}
+}
+
+// What the lights show right at sunset and sunrise for where the fades are put around them
+func TestFadeAlignment(t *testing.T) {
+	tests := []struct {
+		alignment string
+		atSunset, atSunrise int // -1 for halfway
+	}{
+		{"center", -1, -1},
+		{"", -1, -1},
+		{"before", MAX_POWER, 0},
+		{"after", 0, MAX_POWER},
+	}
+	for _, test := range tests {
+		c, _, start := replayController(t, "Europe/Amsterdam", 52.37, 4.90)
+		c.cfg.Settings.FadeAlignment = test.alignment
+		noon := start.AddDate(0, 2, 19).Add(12 * time.Hour)
+		sunset := c.nextSunset(noon)
+		sunrise := c.nextSunrise(sunset)
+
+		for _, event := range []struct {
+			name string
+			at time.Time
+			expected int
+		}{{"sunset", sunset, test.atSunset}, {"sunrise", sunrise, test.atSunrise}} {
+			power := c.ComputeScheduledPower(event.at)
+			if event.expected < 0 && (power < MAX_POWER / 2 - 5 || power > MAX_POWER / 2 + 5) {
+				t.Errorf("%q: %d at %s, expected halfway", test.alignment, power, event.name)
+			} else if event.expected >= 0 && power != event.expected {
+				t.Errorf("%q: %d at %s, expected %d", test.alignment, power, event.name, event.expected)
+			}
+		}
+	}
+}
+
+// Right after the fade in the cool colours are boosted and the warm ones lowered, decaying to the normal mix
+func TestBlueHour(t *testing.T) {
+	c, _, start := replayController(t, "Europe/Amsterdam", 52.37, 4.90)
+	c.cfg.Settings.BlueHour = 60
+	c.cfg.Settings.BlueHourDuration = "30m"
+	sunset := c.nextSunset(start.AddDate(0, 2, 19).Add(12 * time.Hour))
+	window := sunset.Add(c.fadeOffset() + c.transitionDuration)
+
+	tests := []struct {
+		name string
+		at time.Time
+		boost int
+	}{
+		{"during the fade in", window.Add(-time.Minute), 0},
+		{"start", window, 60},
+		{"halfway", window.Add(15 * time.Minute), 30},
+		{"end", window.Add(30 * time.Minute), 0},
+		{"after", window.Add(time.Hour), 0},
+	}
+	for _, test := range tests {
+		f := c.renderFrame(test.at, 100)
+		for led, level := range f {
+			expected := 100 - test.boost // Red, orange, yellow and green
+			if ring := led % COLOUR_COUNT; ring >= 4 {
+				expected = 100 + test.boost // Blue and white
+			}
+			if int(level) != expected {
+				t.Errorf("%s: %s of arm %d at %d, expected %d", test.name, colours[led % COLOUR_COUNT], led / COLOUR_COUNT, level, expected)
+			}
+		}
+	}
+
+	// Off by default
+	c.cfg.Settings.BlueHour = 0
+	if f := c.renderFrame(window, 100); f != uniformFrame(100) {
+		t.Errorf("boosted to %v without a blue hour", f)
+	}
+}
+
+// The overshoot rises to full brightness, peaks right as the rise is over and eases down onto the hold brightness
+func TestOvershootCurve(t *testing.T) {
+	cfg := testConfig()
+	c, _ := newTestController(t, cfg)
+	if c.holdPower() != MAX_POWER || c.fadeInPower(c.transitionDuration + time.Hour) != MAX_POWER || c.overshootSettle() != 0 {
+		t.Fatalf("holding %d without the overshoot", c.holdPower())
+	}
+
+	cfg.Settings.FadeInEasing = "overshoot"
+	cfg.Settings.OvershootPeak = 40
+	cfg.Settings.OvershootSettle = "10m"
+	c, _ = newTestController(t, cfg)
+	rise, settle := c.transitionDuration, 10 * time.Minute
+	if c.holdPower() != MAX_POWER - 40 {
+		t.Fatalf("holding %d", c.holdPower())
+	}
+
+	peak, peakAt, last := 0.0, time.Duration(0), 0.0
+	for elapsed := time.Duration(0); elapsed <= rise + settle + time.Minute; elapsed += 10 * time.Second {
+		level := c.fadeInCurve(elapsed)
+		if level > MAX_POWER || (elapsed > rise && level < MAX_POWER - 40) {
+			t.Fatalf("at %f after %v", level, elapsed)
+		}
+		if level > peak {
+			peak, peakAt = level, elapsed
+		}
+		if elapsed > rise && level > last {
+			t.Fatalf("going up again to %f after %v while settling", level, elapsed)
+		}
+		last = level
+		if complete := c.fadeInComplete(elapsed, c.fadeInPower(elapsed)); complete != (elapsed >= rise + settle) {
+			t.Fatalf("complete %v after %v", complete, elapsed)
+		}
+	}
+	if peak != MAX_POWER || peakAt != rise {
+		t.Fatalf("peak of %f after %v, expected %d at the end of the rise", peak, peakAt, MAX_POWER)
+	}
+	if halfway := c.fadeInPower(rise + settle / 2); halfway != MAX_POWER - 20 {
+		t.Fatalf("at %d halfway through settling", halfway)
+	}
+	if settled := c.fadeInPower(rise + settle); settled != MAX_POWER - 40 {
+		t.Fatalf("settled at %d", settled)
+	}
+}
+
+// The brightness to start at for any time of a day, the lights are on through the night and fade around the sun
+func TestComputeScheduledPower(t *testing.T) {
+	c, _, start := replayController(t, "Europe/Amsterdam", 52.37, 4.90)
+	equinox := start.AddDate(0, 2, 19) // 20 March
+	sunrise, sunset := c.nextSunrise(equinox), c.nextSunset(equinox)
+	tests := []struct {
+		name string
+		now time.Time
+		min, max int
+	}{
+		{"before sunrise", equinox.Add(4 * time.Hour), MAX_POWER, MAX_POWER},
+		{"fading out at sunrise", sunrise, MAX_POWER / 2 - 5, MAX_POWER / 2 + 5},
+		{"midday", equinox.Add(12 * time.Hour), 0, 0},
+		{"fading in at sunset", sunset, MAX_POWER / 2 - 5, MAX_POWER / 2 + 5},
+		{"after sunset", sunset.Add(c.transitionDuration), MAX_POWER, MAX_POWER},
+		{"midnight", equinox.Add(24 * time.Hour), MAX_POWER, MAX_POWER},
+	}
+	for _, test := range tests {
+		if power := c.ComputeScheduledPower(test.now); power < test.min || power > test.max {
+			t.Errorf("%s (%s): brightness %d, expected %d to %d", test.name, test.now.Format("15:04"), power, test.min, test.max)
+		}
+	}
+}
+
+func TestDoNotDisturbOverMidnight(t *testing.T) {
+	cfg := testConfig()
+	cfg.Settings.DoNotDisturb = "23:30-06:00"
+	c, _ := newTestController(t, cfg)
+
+	tests := []struct {
+		hour, minute int
+		dark bool
+		until time.Duration
+	}{
+		{12, 0, false, 11 * time.Hour + 30 * time.Minute},
+		{23, 29, false, time.Minute},
+		{23, 30, true, 6 * time.Hour + 30 * time.Minute},
+		{0, 0, true, 6 * time.Hour},
+		{5, 59, true, time.Minute},
+		{6, 0, false, 17 * time.Hour + 30 * time.Minute},
+	}
+	for _, test := range tests {
+		now := time.Date(2025, 1, 1, test.hour, test.minute, 0, 0, time.Local)
+		if dark := c.doNotDisturb(now); dark != test.dark {
+			t.Errorf("%02d:%02d: do not disturb is %v", test.hour, test.minute, dark)
+		}
+		if until := c.untilDoNotDisturbChange(now); until != test.until {
+			t.Errorf("%02d:%02d: changes in %v, expected %v", test.hour, test.minute, until, test.until)
+		}
+	}
+
+	// Lifted, the lights are back until the window is over
+	now := time.Date(2025, 1, 1, 1, 0, 0, 0, time.Local)
+	c.dndLiftedUntil = now.Add(c.untilDoNotDisturbChange(now))
+	if c.doNotDisturb(now) || c.doNotDisturb(now.Add(4 * time.Hour)) {
+		t.Error("still dark after lifting the window")
+	}
+	if !c.doNotDisturb(now.Add(22 * time.Hour + 30 * time.Minute)) {
+		t.Error("not dark in the next window")
+	}
+}
+
+func TestMinimumWindows(t *testing.T) {
+	c, _, start := replayController(t, "Europe/Oslo", 59.91, 10.75)
+	c.cfg.Settings.MinOnWindow = "6h"
+	c.cfg.Settings.MinOffWindow = "8h"
+
+	// The summer nights and winter days of Oslo are shorter, the lights stay on (and off) for the minimum anyway
+	for day := 0; day < 365; day++ {
+		fadeIn := c.nextFadeIn(start.AddDate(0, 0, day))
+		fadeOut := c.nextFadeOut(fadeIn)
+		if on := fadeOut.Sub(fadeIn.Add(c.transitionDuration)); on < 6 * time.Hour - time.Minute {
+			t.Fatalf("fade in at %s: on for %v until the fade out at %s", fadeIn, on, fadeOut)
+		}
+		nextFadeIn := c.nextFadeIn(fadeOut)
+		if off := nextFadeIn.Sub(fadeOut.Add(c.transitionDuration)); off < 8 * time.Hour - time.Minute {
+			t.Fatalf("fade out at %s: off for %v until the fade in at %s", fadeOut, off, nextFadeIn)
+		}
+	}
+
+	// Days and nights that are long enough are left alone
+	equinox := time.Date(2025, 3, 20, 12, 0, 0, 0, start.Location())
+	sunset, sunrise := c.nextSunset(equinox), c.nextSunrise(equinox)
+	if clamped := c.clampSunset(sunset); !clamped.Equal(sunset) {
+		t.Errorf("sunset %s moved to %s", sunset, clamped)
+	}
+	if clamped := c.clampSunrise(sunrise); !clamped.Equal(sunrise) {
+		t.Errorf("sunrise %s moved to %s", sunrise, clamped)
+	}
+
+	// A short night is stretched evenly around the middle of it
+	midsummer := time.Date(2025, 6, 21, 12, 0, 0, 0, start.Location())
+	sunset = c.nextSunset(midsummer)
+	sunrise = c.nextSunrise(sunset)
+	earlier, later := sunset.Sub(c.clampSunset(sunset)), c.clampSunrise(sunrise).Sub(sunrise)
+	if earlier <= 0 || earlier - later > time.Minute || later - earlier > time.Minute {
+		t.Errorf("night of %s stretched by %v before and %v after", sunset, earlier, later)
+	}
+}
+
+// Count the astrotime calls by what they are asked for, until the test is done
+func countSolarCalls(t *testing.T) map[string]int {
+	t.Helper()
+	calls := make(map[string]int)
+	sunrise, sunset := sunriseAfter, sunsetAfter
+	sunriseAfter = func(after time.Time, latitude float64, longitude float64) time.Time {
+		calls[fmt.Sprintf("sunrise %s %v %v", after, latitude, longitude)]++
+		return sunrise(after, latitude, longitude)
+	}
+	sunsetAfter = func(after time.Time, latitude float64, longitude float64) time.Time {
+		calls[fmt.Sprintf("sunset %s %v %v", after, latitude, longitude)]++
+		return sunset(after, latitude, longitude)
+	}
+	t.Cleanup(func() { sunriseAfter, sunsetAfter = sunrise, sunset })
+	return calls
+}
+
+// A day of the schedule asks astrotime about every day it looks at only once (from midnight and from noon, for
+// the sunrise and the sunset), however often the power is computed
+func TestSolarEventsOncePerDay(t *testing.T) {
+	c, _, start := replayController(t, "Europe/Amsterdam", 52.37, 4.90)
+	calls, before := countSolarCalls(t), c.solarCalculations()
+	for now := start; now.Before(start.AddDate(0, 0, 1)); now = now.Add(time.Minute) {
+		c.ComputeScheduledPower(now)
+		c.nextFadeIn(now)
+		c.nextFadeOut(now)
+	}
+	if len(calls) == 0 {
+		t.Fatal("astrotime never called")
+	}
+	for call, count := range calls {
+		if count != 1 {
+			t.Errorf("%s: called %d times", call, count)
+		}
+	}
+	if days := c.solarCalculations() - before; len(calls) != 4 * days {
+		t.Errorf("%d astrotime calls for %d days", len(calls), days)
+	}
+
+	// New coordinates are another day, and calculated again
+	calls = countSolarCalls(t)
+	c.cfg.Settings.Latitude = 59.91
+	c.ComputeScheduledPower(start.Add(12 * time.Hour))
+	if len(calls) == 0 {
+		t.Error("astrotime not called for new coordinates")
+	}
+}
+
+// Checking a year of fades for the configuration goes through a cache too
+func TestFadesAlwaysOverlapOncePerDay(t *testing.T) {
+	replayController(t, "Europe/Amsterdam", 52.37, 4.90)
+	cfg := testConfig()
+	calls := countSolarCalls(t)
+
+	// Nothing settles with a transition of a whole day, so all of the year is checked
+	if !fadesAlwaysOverlap(&cfg, 24 * time.Hour) {
+		t.Fatal("fades of a day do not overlap")
+	}
+	if len(calls) < 4 * 366 {
+		t.Errorf("%d astrotime calls for a year", len(calls))
+	}
+	for call, count := range calls {
+		if count != 1 {
+			t.Errorf("%s: called %d times", call, count)
+		}
+	}
+}
+
+// Everything the render path parses set, a frame in the middle of a fade
+func BenchmarkRenderFrame(b *testing.B) {
+	cfg := testConfig()
+	cfg.Settings.WhiteBalance = "warm"
+	cfg.Settings.PilotLED = "arm 0"
+	cfg.Settings.PilotBrightness = 5
+	cfg.Settings.DoNotDisturb = "23:30-06:00"
+	c, _ := newTestController(b, cfg)
+	now := time.Date(2025, 1, 1, 17, 0, 0, 0, time.Local)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		outputFrame(c.renderFrame(now, 128), c.doNotDisturb(now), c.render.calibration)
+	}
+}
+
+// The same moment in the log lines of a controller in every display timezone
+func TestDisplayTimezone(t *testing.T) {
+	moment := time.Date(2025, 1, 15, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		zone string
+		time string
+		clock string
+	}{
+		{"UTC", "12:00:00 UTC on 1/15/2025", "12:00:00 UTC"},
+		{"Asia/Tokyo", "21:00:00 JST on 1/15/2025", "21:00:00 JST"},
+		{"America/New_York", "07:00:00 EST on 1/15/2025", "07:00:00 EST"},
+		{"Pacific/Auckland", "01:00:00 NZDT on 1/16/2025", "01:00:00 NZDT"},
+	}
+	for _, test := range tests {
+		if _, err := time.LoadLocation(test.zone); err != nil {
+			t.Skipf("no time zone %s: %v", test.zone, err)
+		}
+		cfg := testConfig()
+		cfg.Settings.DisplayTimezone = test.zone
+		c, _ := newTestController(t, cfg)
+		if logged := c.logTime(moment); logged != test.time {
+			t.Errorf("%s: logged %s, expected %s", test.zone, logged, test.time)
+		}
+		if logged := c.logClock(moment.In(time.Local)); logged != test.clock {
+			t.Errorf("%s: logged %s, expected %s", test.zone, logged, test.clock)
+		}
+	}
+
+	// Without one it is the local timezone, a name that does not exist is rejected
+	c, _ := newTestController(t, testConfig())
+	if logged, expected := c.logClock(moment), moment.In(time.Local).Format(LOG_CLOCK_FORMAT); logged != expected {
+		t.Errorf("logged %s, expected the local %s", logged, expected)
+	}
+	cfg := testConfig()
+	cfg.Settings.DisplayTimezone = "Europe/Atlantis"
+	if err := validateConfig(&cfg); err == nil {
+		t.Error("an unknown display timezone was accepted")
+	}
+}
+
+// The pilot light stays lit while the rest is off, only brighter output goes over it and only an override or do not
+// disturb switch it off
+func TestPilotLight(t *testing.T) {
+	cfg := testConfig()
+	cfg.Settings.PilotLED = "5"
+	c, glow := newTestController(t, cfg)
+	now := time.Now()
+
+	c.setGlow(0)
+	for led, level := range glow.last() {
+		expected := uint8(0)
+		if led == 5 {
+			expected = 8
+		}
+		if level != expected {
+			t.Errorf("LED %d at %d while off, expected %d", led, level, expected)
+		}
+	}
+	if f := c.renderFrame(now, 100); f != uniformFrame(100) {
+		t.Errorf("rendered %v for 100, expected all at 100", f)
+	}
+	if f := outputFrame(c.renderFrame(now, 0), true, c.render.calibration); f != (frame{}) {
+		t.Errorf("wrote %v during do not disturb", f)
+	}
+
+	release := make(chan struct{})
+	if err := c.startOverride("test", func() { <-release }); err != nil {
+		t.Fatal(err)
+	}
+	if f := c.renderFrame(now, 0); f != (frame{}) {
+		t.Errorf("rendered %v during an override", f)
+	}
+	close(release)
+	for i := 0; i < 100 && c.currentOverride() != ""; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A whole arm
+	c.cfg.Settings.PilotLED = "arm 2"
+	c.cfg.Settings.PilotBrightness = 20
+	c.initRender()
+	for led, level := range c.renderFrame(now, 0) {
+		expected := uint8(0)
+		if led / COLOUR_COUNT == 2 {
+			expected = 20
+		}
+		if level != expected {
+			t.Errorf("LED %d at %d with the pilot on arm 2, expected %d", led, level, expected)
+		}
+	}
+}
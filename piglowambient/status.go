@@ -0,0 +1,257 @@
+package piglowambient
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// What the controller is doing, shared by the log, the control socket and HTTP so they always agree
+type Status struct {
+	Phase string `json:"phase"`
+	Power int `json:"power"`
+	TransitionSpeed string `json:"transitionSpeed"`
+	Channels []int `json:"channels"`
+	Colours map[string]int `json:"colours"`
+	Paused bool `json:"paused"`
+	PauseReason string `json:"pauseReason,omitempty"`
+	DoNotDisturb bool `json:"doNotDisturb"`
+	ConfigError bool `json:"configError"`
+	Override string `json:"override,omitempty"`
+	Profile string `json:"profile,omitempty"`
+	NextFadeIn time.Time `json:"nextFadeIn"`
+	NextFadeOut time.Time `json:"nextFadeOut"`
+	Ping string `json:"ping"`
+	PingSimulated bool `json:"pingSimulated"`
+	SkippedWrites int `json:"skippedWrites"`
+	MeasuredWriteRate float64 `json:"measuredWriteRate,omitempty"`
+	MaxWriteRate float64 `json:"maxWriteRate,omitempty"`
+	UptimeSeconds int64 `json:"uptimeSeconds"`
+	Sunrise time.Time `json:"sunrise"`
+	Sunset time.Time `json:"sunset"`
+	SolarNoon time.Time `json:"solarNoon"`
+	DayLengthSeconds int64 `json:"dayLengthSeconds"`
+	SolarCalculations int `json:"solarCalculations"`
+	Fades []FadeRecord `json:"fades"`
+	DeviceAsleep bool `json:"deviceAsleep"`
+	GlowFailures int `json:"glowFailures,omitempty"`
+	Degraded bool `json:"degraded"`
+	LastError string `json:"lastError,omitempty"`
+	LastErrorTime *time.Time `json:"lastErrorTime,omitempty"`
+}
+
+// Subsystems that run on a fallback or are in an error state, safe to use from every goroutine
+type health struct {
+	lock sync.Mutex
+	problems map[string]string
+	lastError string
+	lastErrorTime time.Time
+}
+
+// A subsystem runs on a fallback or failed
+func (c *Controller) degrade(subsystem string, err string) {
+	c.health.lock.Lock()
+	defer c.health.lock.Unlock()
+	if c.health.problems == nil {
+		c.health.problems = make(map[string]string)
+	}
+	c.health.problems[subsystem] = err
+	c.health.lastError = subsystem + ": " + err
+	c.health.lastErrorTime = time.Now()
+}
+
+// A subsystem works normally (again)
+func (c *Controller) recover(subsystem string) {
+	c.health.lock.Lock()
+	defer c.health.lock.Unlock()
+	delete(c.health.problems, subsystem)
+}
+
+// Whether anything is degraded, the last error (which may have been recovered from since) and when it happened
+func (c *Controller) Health() (bool, string, time.Time) {
+	c.health.lock.Lock()
+	defer c.health.lock.Unlock()
+	return len(c.health.problems) > 0, c.health.lastError, c.health.lastErrorTime
+}
+
+// When a fade completed compared to when it was scheduled to
+type FadeRecord struct {
+	Fade string `json:"fade"`
+	Scheduled time.Time `json:"scheduled"`
+	Completed time.Time `json:"completed"`
+	DelayMillis int64 `json:"delayMillis"`
+}
+
+const FADE_HISTORY = 10
+
+// Keep the completion of a fade, only the last few are kept
+func (c *Controller) recordFade(fade string, scheduled time.Time) {
+	// Finished before we started (e.g. starting at night), nothing to measure
+	if scheduled.Before(c.started) {
+		return
+	}
+
+	now := time.Now()
+	c.fadeHistory = append(c.fadeHistory, FadeRecord{Fade: fade, Scheduled: scheduled, Completed: now, DelayMillis: now.Sub(scheduled).Milliseconds()})
+	if len(c.fadeHistory) > FADE_HISTORY {
+		c.fadeHistory = c.fadeHistory[len(c.fadeHistory) - FADE_HISTORY:]
+	}
+}
+
+// Gather the current status
+func (c *Controller) Status() Status {
+	now := time.Now()
+	solar := c.solarToday(now)
+	c.writeLock.Lock()
+	lastFrame, skippedWrites, deviceAsleep, glowFailures := c.lastFrame, c.skippedWrites, c.deviceAsleep, c.glowFailures
+	c.writeLock.Unlock()
+	status := Status{
+		Phase: c.phase(now),
+		Power: c.power(),
+		TransitionSpeed: c.cfg.Settings.TransitionSpeed,
+		Channels: make([]int, LED_COUNT),
+		Colours: make(map[string]int),
+		Paused: c.isPaused,
+		ConfigError: c.configError,
+		Override: c.currentOverride(),
+		DoNotDisturb: c.doNotDisturb(now),
+		Profile: c.profile,
+		NextFadeIn: c.fadeInTime,
+		NextFadeOut: c.fadeOutTime,
+		Ping: pingStateName(c.pingState),
+		PingSimulated: c.pingSimulated(),
+		SkippedWrites: skippedWrites,
+		MeasuredWriteRate: c.measuredWriteRate,
+		MaxWriteRate: c.maxWriteRate(),
+		DeviceAsleep: deviceAsleep,
+		GlowFailures: glowFailures,
+		Sunrise: c.displayTime(solar.sunrise),
+		Sunset: c.displayTime(solar.sunset),
+		SolarNoon: solar.noon,
+		DayLengthSeconds: int64(solar.length.Seconds()),
+		SolarCalculations: c.solarCalculations(),
+		Fades: append([]FadeRecord{}, c.fadeHistory...),
+	}
+	for i, level := range lastFrame {
+		status.Channels[i] = int(level)
+
+		// The brightest of the arms, they only differ with an effect on part of them
+		colour := colours[i % COLOUR_COUNT]
+		if int(level) >= status.Colours[colour] {
+			status.Colours[colour] = int(level)
+		}
+	}
+	var lastErrorTime time.Time
+	status.Degraded, status.LastError, lastErrorTime = c.Health()
+	if !lastErrorTime.IsZero() {
+		status.LastErrorTime = &lastErrorTime
+	}
+	if c.pausedByPing && c.cfg.Settings.PauseOnUp {
+		status.PauseReason = "ping up"
+	} else if c.pausedByPing {
+		status.PauseReason = "ping down"
+	} else if c.isPaused && c.away {
+		status.PauseReason = "presence"
+	}
+	if !c.started.IsZero() {
+		status.UptimeSeconds = int64(now.Sub(c.started).Seconds())
+	}
+	return status
+}
+
+// How many days the sunrise and sunset were calculated for
+func (c *Controller) solarCalculations() int {
+	c.solarCache.lock.Lock()
+	defer c.solarCache.lock.Unlock()
+	return c.solarCache.calculations
+}
+
+// Part of the day the schedule is in
+func (c *Controller) phase(now time.Time) string {
+	if now.After(c.fadeInTime) && now.Before(c.fadeInTime.Add(time.Duration(c.fadeInSeconds()) * time.Second)) {
+		return "fading in"
+	}
+	if now.After(c.fadeOutTime) && now.Before(c.fadeOutTime.Add(time.Duration(c.fadeOutSeconds()) * time.Second)) {
+		return "fading out"
+	}
+	if c.power() > 0 {
+		return "night"
+	}
+	return "day"
+}
+
+func pingStateName(state int) string {
+	switch state {
+		case PingUp:
+			return "up"
+		case PingDown:
+			return "down"
+		case PingDisabled:
+			return "disabled"
+	}
+	return "unknown"
+}
+
+// One line for people
+func (s Status) String() string {
+	ping := s.Ping
+	if s.PingSimulated {
+		ping += " (simulated)"
+	}
+	text := fmt.Sprintf("power %d, transition speed %s, phase %s, paused %t, config error %t, ping %s, skipped writes %d, uptime %v, sunrise %s, sunset %s",
+		s.Power, s.TransitionSpeed, s.Phase, s.Paused, s.ConfigError, ping, s.SkippedWrites, time.Duration(s.UptimeSeconds) * time.Second,
+		s.Sunrise.Format(LOG_CLOCK_FORMAT), s.Sunset.Format(LOG_CLOCK_FORMAT))
+	if s.DeviceAsleep {
+		text += ", device asleep"
+	}
+	if s.Degraded {
+		text += ", degraded: " + s.LastError
+	}
+	if len(s.Fades) > 0 {
+		last := s.Fades[len(s.Fades) - 1]
+		text += fmt.Sprintf(", last fade %s completed %v late", last.Fade, time.Duration(last.DelayMillis) * time.Millisecond)
+	}
+	if s.Profile != "" {
+		text += ", profile " + s.Profile
+	}
+	if s.Override != "" {
+		text += ", running " + s.Override
+	}
+	return text
+}
+
+// The same for scripts
+func (s Status) JSON() string {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Sprintf("error encoding status: %v", err)
+	}
+	return string(data)
+}
+
+// Everything we know about the internal state for finding out why the lights got stuck, optionally with the stack of
+// every goroutine. Reads the state without taking any lock so it also works when something hangs.
+func (c *Controller) DebugDump(stacks bool) string {
+	var dump strings.Builder
+	fmt.Fprintf(&dump, "Status: %s\n", c.Status())
+	fmt.Fprintf(&dump, "Schedule: transition %ds, sleep %v, fade in %v, fade out %v, schedule changed %t\n", c.transitionTime, c.sleepDuration, c.fadeInTime, c.fadeOutTime, c.scheduleChanged)
+	fmt.Fprintf(&dump, "Output: last frame %v, pending frame %t, dithering %t, hold effect %t\n", c.lastFrame, c.pendingFrameValid, c.dithering, c.holdEffect(time.Now()))
+	fmt.Fprintf(&dump, "Other: ping generation %d, geo retrying %t, sunrise hook fired %t, state unwritable %t, goroutines %d\n", c.pingGeneration, c.geoCache.retrying, c.sunriseHookFired, c.stateUnwritable, runtime.NumGoroutine())
+	if stacks {
+		buf := make([]byte, 1 << 20)
+		buf = buf[:runtime.Stack(buf, true)]
+		dump.Write(buf)
+	}
+	return strings.TrimRight(dump.String(), "\n")
+}
+
+// Write the debug dump to the log
+func (c *Controller) LogDebug(stacks bool) {
+	for _, line := range strings.Split(c.DebugDump(stacks), "\n") {
+		log.Printf("Debug: %s", line)
+	}
+}
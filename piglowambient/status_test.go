@@ -0,0 +1,123 @@
+package piglowambient
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The JSON status scripts rely on, written out on its own so a change to Status shows up here
+type statusSchema struct {
+	Phase string `json:"phase"`
+	Power int `json:"power"`
+	TransitionSpeed string `json:"transitionSpeed"`
+	Channels []int `json:"channels"`
+	Colours map[string]int `json:"colours"`
+	Paused bool `json:"paused"`
+	PauseReason string `json:"pauseReason,omitempty"`
+	DoNotDisturb bool `json:"doNotDisturb"`
+	ConfigError bool `json:"configError"`
+	Override string `json:"override,omitempty"`
+	Profile string `json:"profile,omitempty"`
+	NextFadeIn time.Time `json:"nextFadeIn"`
+	NextFadeOut time.Time `json:"nextFadeOut"`
+	Ping string `json:"ping"`
+	PingSimulated bool `json:"pingSimulated"`
+	SkippedWrites int `json:"skippedWrites"`
+	MeasuredWriteRate float64 `json:"measuredWriteRate,omitempty"`
+	MaxWriteRate float64 `json:"maxWriteRate,omitempty"`
+	UptimeSeconds int64 `json:"uptimeSeconds"`
+	Sunrise time.Time `json:"sunrise"`
+	Sunset time.Time `json:"sunset"`
+	SolarNoon time.Time `json:"solarNoon"`
+	DayLengthSeconds int64 `json:"dayLengthSeconds"`
+	SolarCalculations int `json:"solarCalculations"`
+	Fades []struct {
+		Fade string `json:"fade"`
+		Scheduled time.Time `json:"scheduled"`
+		Completed time.Time `json:"completed"`
+		DelayMillis int64 `json:"delayMillis"`
+	} `json:"fades"`
+	DeviceAsleep bool `json:"deviceAsleep"`
+	GlowFailures int `json:"glowFailures,omitempty"`
+	Degraded bool `json:"degraded"`
+	LastError string `json:"lastError,omitempty"`
+	LastErrorTime *time.Time `json:"lastErrorTime,omitempty"`
+}
+
+// Decode a status into the schema, nothing may be missing that is always there and nothing may be unknown
+func checkStatusSchema(t *testing.T, source string, data string) statusSchema {
+	t.Helper()
+	var status statusSchema
+	decoder := json.NewDecoder(strings.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&status); err != nil {
+		t.Fatalf("%s: %v in %s", source, err, data)
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(data), &fields); err != nil {
+		t.Fatal(err)
+	}
+	schema := reflect.TypeOf(status)
+	for i := 0; i < schema.NumField(); i++ {
+		tag := schema.Field(i).Tag.Get("json")
+		if name := strings.Split(tag, ",")[0]; !strings.Contains(tag, "omitempty") && fields[name] == nil {
+			t.Errorf("%s: no %s", source, name)
+		}
+	}
+	return status
+}
+
+// The socket, HTTP and Status itself give the same JSON
+func TestStatusJSONSchema(t *testing.T) {
+	c, _ := newTestController(t, testConfig())
+	c.started = time.Now().Add(-time.Minute)
+	c.setGlow(100)
+	c.degrade("ping", "no reply")
+
+	status := checkStatusSchema(t, "Status", c.Status().JSON())
+	if len(status.Channels) != LED_COUNT || len(status.Colours) != COLOUR_COUNT || status.Channels[0] != 100 {
+		t.Errorf("channels %v and colours %v", status.Channels, status.Colours)
+	}
+	if !status.Degraded || status.LastError != "ping: no reply" || status.LastErrorTime == nil {
+		t.Errorf("degraded %v with %q at %v", status.Degraded, status.LastError, status.LastErrorTime)
+	}
+	if status.NextFadeIn.IsZero() || status.NextFadeOut.IsZero() || status.UptimeSeconds < 60 {
+		t.Errorf("next fades %s and %s, uptime %d", status.NextFadeIn, status.NextFadeOut, status.UptimeSeconds)
+	}
+
+	checkStatusSchema(t, "status --json", c.Command("status --json"))
+	w := httptest.NewRecorder()
+	c.handleStatus(w, httptest.NewRequest(http.MethodGet, "/status", nil))
+	checkStatusSchema(t, "/status", w.Body.String())
+}
+
+// The channels and the colours are what the PiGlow got written, after the calibration and for the arm in use
+func TestStatusChannelsMatchWrites(t *testing.T) {
+	cfg := testConfig()
+	cfg.Settings.ActiveArm = "1"
+	cfg.Colors.RedMax = 100
+	cfg.Colors.WhiteGamma = 2
+	c, glow := newTestController(t, cfg)
+	c.setGlow(200)
+
+	written := glow.last()
+	status := c.Status()
+	for led, level := range written {
+		if status.Channels[led] != int(level) {
+			t.Errorf("LED %d at %d, wrote %d", led, status.Channels[led], level)
+		}
+	}
+	expected := map[string]int{"red": 100, "orange": 200, "yellow": 200, "green": 200, "blue": 200, "white": 157}
+	if !reflect.DeepEqual(status.Colours, expected) {
+		t.Errorf("colours %v, expected %v", status.Colours, expected)
+	}
+	if written[0] != 0 || written[COLOUR_COUNT] != 100 || written[2 * COLOUR_COUNT + COLOUR_COUNT - 1] != 0 {
+		t.Errorf("wrote %v, expected only arm 1", written)
+	}
+}
@@ -0,0 +1,155 @@
+package piglowambient
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"time"
+)
+
+// How far the sun is below the horizon at the end of every twilight in the evening (and its start in the morning)
+var twilightAngles = map[string]float64{"civil": 6, "nautical": 12, "astronomical": 18}
+
+// What the lights show at the end of a twilight, a [Twilight "civil"] section
+type Twilight struct {
+	Power Brightness
+
+	// Mix of the colours like WhiteBalance, the WhiteBalance when empty
+	Balance string
+}
+
+// A moment of the night the twilight schedule goes through
+type twilightPoint struct {
+	name string
+	time time.Time
+	power int
+	balance [COLOUR_COUNT]int
+}
+
+func validateTwilight(conf *Config) error {
+	for name, twilight := range conf.Twilight {
+		if _, ok := twilightAngles[name]; !ok {
+			return fmt.Errorf("Twilight `%s` given, has to be civil, nautical or astronomical", name)
+		}
+		if twilight.Power < 0 || twilight.Power > MAX_POWER {
+			return fmt.Errorf("Twilight %s power is %d, but has to be between 0 and %d", name, twilight.Power, MAX_POWER)
+		}
+		if _, err := getWhiteBalance(twilight.Balance); err != nil {
+			return fmt.Errorf("Twilight %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// Configured twilights from the one closest to the horizon to the darkest
+func (c *Controller) twilightNames() []string {
+	var names []string
+	for name := range c.cfg.Twilight {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return twilightAngles[names[i]] < twilightAngles[names[j]] })
+	return names
+}
+
+// Moment the sun is the given angle below the horizon in the evening (or the morning) of the day midnight starts,
+// false when it does not get that low that day. After the NOAA solar calculations, which are within a minute or so.
+func sunBelowHorizon(midnight time.Time, latitude float64, longitude float64, angle float64, morning bool) (time.Time, bool) {
+	year, month, day := midnight.Date()
+	noon := time.Date(year, month, day, 12, 0, 0, 0, time.UTC)
+	fraction := 2 * math.Pi / 365 * float64(noon.YearDay() - 1)
+
+	// Equation of time in minutes and the declination of the sun in radians
+	eqTime := 229.18 * (0.000075 + 0.001868 * math.Cos(fraction) - 0.032077 * math.Sin(fraction) - 0.014615 * math.Cos(2 * fraction) - 0.040849 * math.Sin(2 * fraction))
+	declination := 0.006918 - 0.399912 * math.Cos(fraction) + 0.070257 * math.Sin(fraction) - 0.006758 * math.Cos(2 * fraction) + 0.000907 * math.Sin(2 * fraction) - 0.002697 * math.Cos(3 * fraction) + 0.00148 * math.Sin(3 * fraction)
+
+	lat := latitude * math.Pi / 180
+	zenith := (90 + angle) * math.Pi / 180
+	cosHourAngle := (math.Cos(zenith) - math.Sin(lat) * math.Sin(declination)) / (math.Cos(lat) * math.Cos(declination))
+	if cosHourAngle < -1 || cosHourAngle > 1 {
+		return time.Time{}, false
+	}
+
+	hourAngle := math.Acos(cosHourAngle) * 180 / math.Pi
+	if !morning {
+		hourAngle = -hourAngle
+	}
+	minutes := 720 - 4 * (longitude + hourAngle) - eqTime
+	midnightUtc := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	return midnightUtc.Add(time.Duration(minutes * float64(time.Minute))).In(midnight.Location()), true
+}
+
+// The points of the night around now, from sunset through the twilights to the darkest one and back to sunrise
+func (c *Controller) twilightPoints(now time.Time) []twilightPoint {
+	sunset := c.previousSunset(now)
+	sunrise := c.nextSunrise(sunset)
+
+	names := c.twilightNames()
+	balanceOf := func(name string) [COLOUR_COUNT]int {
+		if balance, ok := c.render.twilightBalance[name]; ok {
+			return balance
+		}
+		return c.render.balance
+	}
+
+	points := []twilightPoint{{name: "sunset", time: sunset, balance: balanceOf(names[0])}}
+	var dawns []twilightPoint
+	for _, name := range names {
+		dusk, ok := c.twilightTime(sunset, name, false)
+		dawn, okDawn := c.twilightTime(sunrise, name, true)
+		if !ok || !okDawn || !dusk.After(points[len(points) - 1].time) || !dawn.Before(sunrise) {
+			continue // The sun does not get this far below the horizon tonight
+		}
+		points = append(points, twilightPoint{name: name + " dusk", time: dusk, power: int(c.cfg.Twilight[name].Power), balance: balanceOf(name)})
+		dawns = append([]twilightPoint{{name: name + " dawn", time: dawn, power: int(c.cfg.Twilight[name].Power), balance: balanceOf(name)}}, dawns...)
+	}
+	points = append(points, dawns...)
+	return append(points, twilightPoint{name: "sunrise", time: sunrise, balance: balanceOf(names[0])})
+}
+
+// When a twilight ends in the evening of the day of its sunset, or starts in the morning of the day of its sunrise
+func (c *Controller) twilightTime(event time.Time, name string, morning bool) (time.Time, bool) {
+	events := c.solarEvents(event)
+	if morning {
+		t, ok := events.dawn[name]
+		return t, ok
+	}
+	t, ok := events.dusk[name]
+	return t, ok
+}
+
+// Brightness, mix of the colours and the name of the last point passed, in between two points it goes in a straight
+// line. False during the day.
+func (c *Controller) twilightTarget(now time.Time) (int, [COLOUR_COUNT]int, string, bool) {
+	points := c.twilightPoints(now)
+	if !now.After(points[0].time) || !now.Before(points[len(points) - 1].time) {
+		return 0, points[0].balance, "day", false
+	}
+
+	for i := 1; i < len(points); i++ {
+		if now.Before(points[i].time) {
+			previous, next := points[i - 1], points[i]
+			fraction := float64(now.Sub(previous.time)) / float64(next.time.Sub(previous.time))
+			var balance [COLOUR_COUNT]int
+			for ring := range balance {
+				balance[ring] = previous.balance[ring] + int(math.Round(float64(next.balance[ring] - previous.balance[ring]) * fraction))
+			}
+			power := previous.power + int(math.Round(float64(next.power - previous.power) * fraction))
+			return power, balance, previous.name, true
+		}
+	}
+	return 0, points[0].balance, "day", false
+}
+
+// Follow the twilights, announcing when the next one starts
+func (c *Controller) twilightPower(now time.Time) int {
+	power, _, phase, _ := c.twilightTarget(now)
+	if phase != c.twilightPhase {
+		if c.twilightPhase != "" {
+			log.Printf("Twilight phase %s started", phase)
+			c.sendEvent("twilight", phase)
+		}
+		c.twilightPhase = phase
+	}
+	return power
+}
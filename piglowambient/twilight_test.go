@@ -0,0 +1,61 @@
+package piglowambient
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// Step through a day and a night, the phases come one after the other in order and the brightness of every point is
+// reached right at it
+func TestTwilightPhases(t *testing.T) {
+	tests := []struct {
+		name string
+		day time.Time
+		phases []string
+	}{
+		{"winter", time.Date(2025, 1, 15, 12, 0, 0, 0, time.UTC), []string{"sunset", "civil dusk", "nautical dusk", "astronomical dusk", "astronomical dawn", "nautical dawn", "civil dawn", "day"}},
+		{"summer, never astronomically dark", time.Date(2025, 6, 21, 12, 0, 0, 0, time.UTC), []string{"sunset", "civil dusk", "nautical dusk", "nautical dawn", "civil dawn", "day"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, _, start := replayController(t, "Europe/Amsterdam", 52.37, 4.90)
+			c.cfg.Twilight = map[string]*Twilight{"civil": {Power: 200}, "nautical": {Power: 100}, "astronomical": {Power: 50}}
+			c.initSchedule()
+			noon := time.Date(test.day.Year(), test.day.Month(), test.day.Day(), 12, 0, 0, 0, start.Location())
+			logged := captureLog(t)
+
+			var phases []string
+			c.twilightPower(noon)
+			for now := noon; now.Before(noon.Add(24 * time.Hour)); now = now.Add(time.Minute) {
+				phase := c.twilightPhase
+				power := c.twilightPower(now)
+				if c.twilightPhase != phase {
+					phases = append(phases, c.twilightPhase)
+				}
+				if power < 0 || power > 200 {
+					t.Fatalf("at %d at %s", power, now)
+				}
+			}
+			if strings.Join(phases, ", ") != strings.Join(test.phases, ", ") {
+				t.Fatalf("went through %v, expected %v", phases, test.phases)
+			}
+			if started := strings.Count(logged.String(), "Twilight phase"); started != len(test.phases) {
+				t.Errorf("logged %d phases in %q", started, logged.String())
+			}
+
+			points := c.twilightPoints(noon.Add(12 * time.Hour))
+			for i, point := range points {
+				if i > 0 && !point.time.After(points[i - 1].time) {
+					t.Errorf("%s at %s, before %s", point.name, point.time, points[i - 1].name)
+				}
+				if i == 0 || i == len(points) - 1 {
+					continue
+				}
+				if power, _, phase, _ := c.twilightTarget(point.time.Add(time.Millisecond)); power != point.power || phase != point.name {
+					t.Errorf("%s: at %d in phase %s, expected %d", point.name, power, phase, point.power)
+				}
+			}
+		})
+	}
+}